@@ -1,22 +1,22 @@
 package handler
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"math"
+	"net"
 	"net/http"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/loadbalancer"
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/metrics"
 	"github.com/Adarsh-Kmt/WebsocketReverseProxy/rwmutex"
 	"github.com/Adarsh-Kmt/WebsocketReverseProxy/server"
-	"github.com/Adarsh-Kmt/WebsocketReverseProxy/types"
 	"github.com/Adarsh-Kmt/WebsocketReverseProxy/util"
 	"github.com/gookit/ini/v2"
 )
@@ -25,9 +25,21 @@ type HTTPHandler struct {
 	HTTPServerPool        []server.HTTPServer
 	HealthyHTTPServerPool []server.HTTPServer //contains healthy end server structs.
 
-	Algorithm                string
-	HealthyServerIdChannel   chan int
-	UnhealthyServerIdChannel chan int
+	Algorithm string
+	SWRR      *loadbalancer.SmoothWeightedRoundRobin // state of weighted-round-robin algorithm.
+
+	HashRing        *loadbalancer.HashRing // hash ring of healthy servers, used by consistent-hash algorithm.
+	HashKeySource   loadbalancer.HashKeySource
+	HashBoundedLoad float64 // if greater than 0, servers with load greater than HashBoundedLoad times the average load are skipped.
+
+	AffinityCookie *loadbalancer.AffinityCookie // if enabled, users are pinned to the server that handled their first request.
+
+	RetryPolicy server.RetryPolicy // decides wether failed requests are retried on a different server.
+	Routes      []server.Route     // configs that apply to requests matching a path prefix, eg: hedging.
+	Timeouts    server.Timeouts    // timeouts of requests that do not match any route.
+
+	JobQueue     server.JobQueueConfig      // decides the priority class of requests waiting in the queue of a server.
+	FairQueueKey loadbalancer.HashKeySource // identifies the user sending a request, when using fair queuing.
 
 	GlobalRequestId *int
 	GRIDMutex       *sync.Mutex // mutex for updating the global connection ID.
@@ -41,86 +53,88 @@ type HTTPHandler struct {
 	logger *log.Logger
 }
 
-func (httph *HTTPHandler) HealthCheck(wg *sync.WaitGroup) {
-
-	defer wg.Done()
+/*
+HealthCheck checks all servers concurrently, updates the health state of each server, and rebuilds the healthy server pool.
+*/
+func (httph *HTTPHandler) HealthCheck() {
 
-	hsPool := make([]server.HTTPServer, 0, len(httph.HTTPServerPool))
-	hsIdPool := make([]int, 0)
+	wg := &sync.WaitGroup{}
 
 	for _, es := range httph.HTTPServerPool {
 
-		go httph.TestHTTPServer(es)
+		wg.Add(1)
+		go func(es server.HTTPServer) {
+			defer wg.Done()
+			httph.TestHTTPServer(es)
+		}(es)
 	}
 
-	serversResponded := 0
-
-	for serversResponded != len(httph.HTTPServerPool) {
+	wg.Wait()
 
-		select {
+	httph.RebuildHealthyServerPool()
+}
 
-		case serverId := <-httph.HealthyServerIdChannel:
-			//httph.logger.Printf("server %d is healthy...", serverId)
-			//hesPool = append(hesPool, httph.HTTPServerPool[serverId-1])
-			hsIdPool = append(hsIdPool, serverId)
-			serversResponded++
+/*
+RebuildHealthyServerPool builds the healthy server pool using the health state of each server.
+servers with weight 0 are kept out of rotation.
+The pool is only replaced if the set of healthy servers has changed.
+*/
+func (httph *HTTPHandler) RebuildHealthyServerPool() {
 
-		case <-httph.UnhealthyServerIdChannel:
-			serversResponded++
+	hsPool := make([]server.HTTPServer, 0, len(httph.HTTPServerPool))
 
+	for _, hs := range httph.HTTPServerPool {
+		if hs.Health.Status() == server.Healthy && hs.Weight > 0 {
+			hsPool = append(hsPool, hs)
 		}
+	}
 
+	httph.RWMutex.ReadLock()
+	changed := len(hsPool) != len(httph.HealthyHTTPServerPool)
+	for index := 0; !changed && index < len(hsPool); index++ {
+		changed = hsPool[index].ServerId != httph.HealthyHTTPServerPool[index].ServerId
 	}
+	httph.RWMutex.ReadUnlock()
 
-	if httph.Algorithm == "round-robin" {
-		sort.Ints(hsIdPool)
+	if changed {
+		httph.logger.Printf("size of healthy HTTP server pool : %d", len(hsPool))
+		httph.UpdateHealthyServerPool(hsPool)
 	}
-	httph.logger.Printf("length of healthy server id list : %d", len(hsIdPool))
-	for index := range hsIdPool {
-		serverId := hsIdPool[index]
-		hsPool = append(hsPool, httph.HTTPServerPool[serverId-1])
+}
+
+/*
+UpdateHealthyServerPool replaces the healthy server pool, and rebuilds the hash ring used by consistent-hash algorithm.
+*/
+func (httph *HTTPHandler) UpdateHealthyServerPool(hsPool []server.HTTPServer) {
+
+	members := make([]loadbalancer.RingMember, 0, len(hsPool))
+	for _, hs := range hsPool {
+		members = append(members, loadbalancer.RingMember{ServerId: hs.ServerId, Addr: hs.Addr, Weight: hs.Weight})
 	}
-	//httph.logger.Println("finished health check.")
-	//httph.logger.Printf("length of the healthy http server list after health check: %d", len(hesPool))
+	hashRing := loadbalancer.BuildHashRing(members)
 
 	httph.RWMutex.WriteLock()
 	httph.HealthyHTTPServerPool = hsPool
+	httph.HashRing = hashRing
 
 	httph.RWMutex.WriteUnlock()
-
 }
 
 /*
-go routine used to check wether an end server is online, then writes to HealthyEndServerPool in a thread-safe manner.
+TestHTTPServer checks wether a server is online, and records the result in the health state of the server.
+Changes in health state are logged.
 */
 func (httph *HTTPHandler) TestHTTPServer(s server.HTTPServer) {
 
-	response, err := httph.healthCheckClient.Get(fmt.Sprintf("http://" + s.Addr + "/healthCheck"))
+	err := s.HealthCheck.Check(&httph.healthCheckClient, s.Addr)
 
 	if err != nil {
 		httph.logger.Println(s.Addr + " health check error: " + err.Error())
-		httph.UnhealthyServerIdChannel <- s.ServerId
-		return
-	}
-
-	var hcr types.HealthCheckResponse
-	respBody, err := io.ReadAll(response.Body)
-	response.Body.Close()
-	json.Unmarshal(respBody, &hcr)
-
-	if err != nil {
-		httph.logger.Println("error while json decoding health check response: " + err.Error())
-		httph.UnhealthyServerIdChannel <- s.ServerId
-		return
 	}
-	//httph.logger.Printf("response status received from %s : %d\n", s.Addr, hcr.Status)
 
-	if hcr.Status == 200 {
-		httph.HealthyServerIdChannel <- s.ServerId
-	} else {
-		httph.UnhealthyServerIdChannel <- s.ServerId
+	if transition, changed := s.Health.RecordCheck(err); changed {
+		s.Logger.Println(transition.String())
 	}
-
 }
 
 func ConfigureHTTPHandler() (http.Handler, error) {
@@ -150,16 +164,16 @@ func ConfigureHTTPHandler() (http.Handler, error) {
 	} else if hcEnabledString == "true" {
 		healthCheckEnabled = true
 	} else {
-		return nil, fmt.Errorf("invalid config, websocket.enable_health_check should be true/false")
+		return nil, fmt.Errorf("invalid config, http.enable_health_check should be true/false")
 	}
 
 	healthCheckInterval := 10
-	hcIntervalString := cfg.String("websocket.health_check_interval")
+	hcIntervalString := cfg.String("http.health_check_interval")
 
 	if hcIntervalString != "" {
 		val, err := strconv.Atoi(hcIntervalString)
 		if err != nil {
-			return nil, fmt.Errorf("invalid config, websocket.health_check_interval should be a valid integer")
+			return nil, fmt.Errorf("invalid config, http.health_check_interval should be a valid integer")
 		}
 		healthCheckInterval = val
 	}
@@ -168,40 +182,95 @@ func ConfigureHTTPHandler() (http.Handler, error) {
 
 	if algo := cfg.String("http.algorithm"); algo != "" {
 
-		if algo != "round-robin" && algo != "random" {
-			return nil, fmt.Errorf("format for http section:\n\n[http]\nalgorithm={round-robin/random}")
+		if !loadbalancer.IsValidAlgorithm(algo) {
+			return nil, fmt.Errorf("format for http section:\n\n[http]\nalgorithm=%s", loadbalancer.AlgorithmsFormat())
 		}
 		algorithm = algo
 
 	}
+	hashKeySource, err := loadbalancer.ParseHashKeySource(cfg.String("http.hash_key"))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid config, http.%s", err.Error())
+	}
+
+	hashBoundedLoad := 0.0
+
+	if boundedLoadString := cfg.String("http.hash_bounded_load"); boundedLoadString != "" {
+		hashBoundedLoad, err = strconv.ParseFloat(boundedLoadString, 64)
+		if err != nil || hashBoundedLoad < 1 {
+			return nil, fmt.Errorf("invalid config, http.hash_bounded_load should be a number greater than or equal to 1")
+		}
+	}
+
+	affinityCookie := &loadbalancer.AffinityCookie{
+		Name:   cfg.String("frontend.affinity_cookie"),
+		Secret: []byte(cfg.String("frontend.affinity_secret")),
+	}
+
 	httpServerPool, err := server.ConfigureHTTPServers(hs)
 
 	if err != nil {
 		return nil, err
 	}
 
+	retryPolicy, err := server.ConfigureRetryPolicy(hs, "http")
+
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts, err := server.ConfigureTimeouts(hs, server.Timeouts{}, "http.")
+
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := server.ConfigureRoutes(hs, timeouts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	jobQueue, err := server.ConfigureJobQueue(hs, "http")
+
+	if err != nil {
+		return nil, err
+	}
+
+	fairQueueKey, err := loadbalancer.ParseHashKeySource(cfg.String("http.fair_queue_key"))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid config, http.fair_queue_key should be ip/header:{name}/cookie:{name}/query:{name}")
+	}
+
 	grid := 0
 	lg := log.New(os.Stdout, "HTTP_HANDLER :      ", 0)
 	hh := &HTTPHandler{
-		HTTPServerPool:           httpServerPool,
-		HealthyHTTPServerPool:    []server.HTTPServer{},
-		HealthyServerIdChannel:   make(chan int),
-		UnhealthyServerIdChannel: make(chan int),
-		RWMutex:                  rwmutex.InitializeReadWriteMutex(),
-		GRIDMutex:                &sync.Mutex{},
-		GlobalRequestId:          &grid,
-		logger:                   lg,
-		healthCheckClient:        util.InitializeHandlerHTTPClient(lg),
-		Algorithm:                algorithm,
+		HTTPServerPool:        httpServerPool,
+		HealthyHTTPServerPool: []server.HTTPServer{},
+		RWMutex:               rwmutex.InitializeReadWriteMutex(),
+		GRIDMutex:             &sync.Mutex{},
+		GlobalRequestId:       &grid,
+		logger:                lg,
+		healthCheckClient:     util.InitializeHandlerHTTPClient(lg),
+		Algorithm:             algorithm,
+		SWRR:                  loadbalancer.InitializeSmoothWeightedRoundRobin(),
+		HashRing:              loadbalancer.BuildHashRing(nil),
+		HashKeySource:         hashKeySource,
+		HashBoundedLoad:       hashBoundedLoad,
+		AffinityCookie:        affinityCookie,
+		RetryPolicy:           retryPolicy,
+		Routes:                routes,
+		Timeouts:              timeouts,
+		JobQueue:              jobQueue,
+		FairQueueKey:          fairQueueKey,
 	}
 
 	periodicFunc := func(healthCheckInterval int) {
 
 		for {
-			wg := &sync.WaitGroup{}
-			wg.Add(1)
-			hh.HealthCheck(wg)
-			wg.Wait()
+			hh.HealthCheck()
 			time.Sleep(time.Duration(healthCheckInterval) * time.Second)
 		}
 	}
@@ -209,139 +278,415 @@ func ConfigureHTTPHandler() (http.Handler, error) {
 	if healthCheckEnabled {
 		go periodicFunc(healthCheckInterval)
 	} else {
-		hh.HealthyHTTPServerPool = make([]server.HTTPServer, len(hh.HTTPServerPool))
-		copy(hh.HealthyHTTPServerPool, hh.HTTPServerPool)
-		log.Printf("size of healthy HTTP server pool : %d\n", len(hh.HealthyHTTPServerPool))
+		// without health checks, every server is considered healthy.
+		for _, hs := range hh.HTTPServerPool {
+			hs.Health.SetStatus(server.Healthy, "health checks disabled")
+		}
+		hh.RebuildHealthyServerPool()
 	}
 
 	return hh, nil
 }
 
-func (httph *HTTPHandler) ApplyLoadBalancingAlgorithm() server.HTTPServer {
+/*
+ApplyLoadBalancingAlgorithm selects a server from the healthy server pool, using the configured algorithm.
+If the request has an affinity cookie pinning it to a healthy server, that server is selected instead.
+Servers in excludedServerIds, and servers whose circuit breaker is open, are never selected.
+Returns an error if there are no healthy servers that can be selected.
+*/
+func (httph *HTTPHandler) ApplyLoadBalancingAlgorithm(r *http.Request, excludedServerIds map[int]bool) (server.HTTPServer, error) {
 
 	httph.GRIDMutex.Lock()
 	*httph.GlobalRequestId++
 	httpRequestId := *httph.GlobalRequestId
 	httph.GRIDMutex.Unlock()
 
-	var server server.HTTPServer
-	if httph.Algorithm == "round-robin" || httph.Algorithm == "random" {
+	httph.RWMutex.ReadLock()
+	defer httph.RWMutex.ReadUnlock()
+
+	healthyPool := httph.HealthyHTTPServerPool
+
+	if len(healthyPool) == 0 {
+		return server.HTTPServer{}, fmt.Errorf("no healthy http servers available")
+	}
+
+	// servers whose circuit breaker is open are never selected, requests are short circuited to other servers instead.
+	candidates := make([]server.HTTPServer, 0, len(healthyPool))
+
+	for _, s := range healthyPool {
+		if !excludedServerIds[s.ServerId] && s.CircuitBreaker.Ready() {
+			candidates = append(candidates, s)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return server.HTTPServer{}, fmt.Errorf("no http servers available, %d healthy servers excluded or with open circuit breakers", len(healthyPool))
+	}
+
+	// servers temporarily taken out of the pool (eg: ejected by outlier detection) are skipped, unless every candidate has been taken out.
+	pool := make([]server.HTTPServer, 0, len(candidates))
+	availableServerIds := make(map[int]bool, len(candidates))
+
+	for _, s := range candidates {
+		if s.IsAvailable() {
+			pool = append(pool, s)
+			availableServerIds[s.ServerId] = true
+		}
+	}
+
+	if len(pool) == 0 {
+		pool = candidates
+		for _, s := range candidates {
+			availableServerIds[s.ServerId] = true
+		}
+	}
+
+	if identity, ok := httph.AffinityCookie.PinnedServer(r); ok {
+		for _, hs := range pool {
+			if loadbalancer.ServerIdentity(hs.Name) == identity {
+				httph.logger.Printf("received request %d, forwarded to pinned http server %d", httpRequestId, hs.ServerId)
+				return hs, nil
+			}
+		}
+	}
+
+	// fraction of its full weight received by each server, less than 1 for servers in slow start.
+	slowStartFactors := make(map[int]float64, len(pool))
+	for _, s := range pool {
+		slowStartFactors[s.ServerId] = s.SlowStartFactor()
+	}
+
+	slowStartFactor := func(index int) float64 {
+		return slowStartFactors[pool[index].ServerId]
+	}
+
+	// load of servers in slow start is scaled up, so that they receive fewer requests.
+	activeJobs := func(index int) float64 {
+		return float64(pool[index].GetActiveJobs()+1) / slowStartFactor(index)
+	}
+
+	var serverIndex int
+
+	switch httph.Algorithm {
+
+	case loadbalancer.RoundRobin:
+		serverIndex = loadbalancer.SelectRoundRobin(len(pool), httpRequestId, slowStartFactor)
+
+	case loadbalancer.Random:
+		serverIndex = loadbalancer.SelectRandom(len(pool), slowStartFactor)
+
+	case loadbalancer.LeastConnections:
+		serverIndex = loadbalancer.SelectLeastConnections(len(pool), httpRequestId, activeJobs)
 
-		httph.RWMutex.ReadLock()
+	case loadbalancer.PowerOfTwo:
+		serverIndex = loadbalancer.SelectPowerOfTwoChoices(len(pool), activeJobs)
 
-		serverId := httpRequestId % len(httph.HealthyHTTPServerPool)
+	case loadbalancer.WeightedRR:
+		serverIndex = httph.SWRR.Select(len(pool), func(index int) int { return pool[index].ServerId }, func(index int) float64 { return float64(pool[index].Weight) * slowStartFactor(index) })
 
-		server = httph.HealthyHTTPServerPool[serverId]
-		httph.logger.Printf("received request %d, forwarded to http server %d", httpRequestId, server.ServerId)
+	case loadbalancer.ConsistentHash:
+		serverId := httph.HashRing.Select(
+			httph.HashKeySource.Extract(r),
+			httph.HashBoundedLoad,
+			func(serverId int) int { return httph.HTTPServerPool[serverId-1].GetActiveJobs() },
+			func(serverId int) bool { return availableServerIds[serverId] },
+			func(serverId int) float64 { return slowStartFactors[serverId] },
+		)
+		for index := range pool {
+			if pool[index].ServerId == serverId {
+				serverIndex = index
+			}
+		}
+	}
+
+	server := pool[serverIndex]
+	httph.logger.Printf("received request %d, forwarded to http server %d", httpRequestId, server.ServerId)
+
+	return server, nil
+}
+
+// returned by SelectServer when every available server has reached its concurrency limit.
+var errServersOverloaded = errors.New("every available server has reached its concurrency limit")
+
+/*
+SelectServer selects a server using the configured algorithm, and reserves a request with the circuit breaker and concurrency limiter of the selected server.
+A server is selected again if its circuit breaker or concurrency limiter rejects the request,
+which can happen when its last trial request was reserved by another request after selection, or it is overloaded.
+Rejected servers are added to excludedServerIds.
+If every available server is overloaded and wait is true, the request waits in the queue of the first overloaded server, if queuing is enabled.
+Returns errServersOverloaded if no server was selected because of concurrency limits, or the error returned by the queue.
+The permit returned by the circuit breaker is sent along with the request, or used to release it using releaseServer if it is not sent to the selected server.
+*/
+func (httph *HTTPHandler) SelectServer(r *http.Request, excludedServerIds map[int]bool, wait bool) (server.HTTPServer, server.CircuitPermit, error) {
+
+	var overloaded *server.HTTPServer // first server rejected by its concurrency limiter.
+
+	for {
+		httpServer, err := httph.ApplyLoadBalancingAlgorithm(r, excludedServerIds)
+
+		if err != nil {
+			if overloaded != nil {
+				return httph.waitForServer(r, *overloaded, wait)
+			}
+			return server.HTTPServer{}, server.CircuitPermit{}, err
+		}
+
+		if permit, ok := httpServer.CircuitBreaker.Acquire(); ok {
+			if httpServer.ConcurrencyLimiter.Acquire() {
+				return httpServer, permit, nil
+			}
+			httpServer.CircuitBreaker.RecordResult(permit, server.Ignored, 0)
+			if overloaded == nil {
+				overloaded = &httpServer
+			}
+		}
+		excludedServerIds[httpServer.ServerId] = true
+	}
+}
+
+// waitForServer queues the request until it is admitted by the concurrency limiter of the overloaded server.
+func (httph *HTTPHandler) waitForServer(r *http.Request, httpServer server.HTTPServer, wait bool) (server.HTTPServer, server.CircuitPermit, error) {
+
+	if !wait || !httpServer.ConcurrencyLimiter.QueueEnabled() {
+		return server.HTTPServer{}, server.CircuitPermit{}, errServersOverloaded
+	}
+
+	permit, ok := httpServer.CircuitBreaker.Acquire()
+	if !ok {
+		return server.HTTPServer{}, server.CircuitPermit{}, errServersOverloaded
+	}
+
+	if err := httpServer.ConcurrencyLimiter.Wait(r.Context(), httph.queueEntry(r)); err != nil {
+		httpServer.CircuitBreaker.RecordResult(permit, server.Ignored, 0)
+		return server.HTTPServer{}, server.CircuitPermit{}, err
+	}
+	return httpServer, permit, nil
+}
+
+/*
+queueEntry returns the queue entry of the request. Its priority class is read from the priority header if it is present and valid,
+or from the matching route, and is normal otherwise.
+*/
+func (httph *HTTPHandler) queueEntry(r *http.Request) *server.QueueEntry {
+
+	class := server.PriorityNormal
+
+	if route := server.MatchRoute(httph.Routes, r.URL.Path); route != nil {
+		class = route.Priority
+	}
+	// the priority header can be set by any user, so it is only honoured if the request was received from a trusted proxy.
+	if header := httph.JobQueue.PriorityHeader; header != "" && util.FromTrustedProxy(r.Context()) {
+		if priority, ok := server.ParsePriority(r.Header.Get(header)); ok {
+			class = priority
+		}
+	}
+
+	return server.InitializeQueueEntry(class, httph.FairQueueKey.Extract(r))
+}
+
+// releaseServer releases a request reserved by SelectServer, which was not sent to the server.
+func releaseServer(httpServer server.HTTPServer, permit server.CircuitPermit) {
+
+	// request was never sent to the server, so it does not count towards the circuit breaker.
+	httpServer.CircuitBreaker.RecordResult(permit, server.Ignored, 0)
+	httpServer.ConcurrencyLimiter.Release()
+}
+
+/*
+SendJob assigns the job to a worker of the server, spawning a worker if every worker is busy.
+Returns the error of the job's context if it is done before the job is assigned.
+*/
+func (httph *HTTPHandler) SendJob(httpServer server.HTTPServer, job server.Job) error {
+
+	httpServer.ScaleWorkers()
 
-		httph.RWMutex.ReadUnlock()
+	select {
 
+	case httpServer.JobChannel <- job:
+		return nil
+
+	case <-job.Context.Done():
+		return job.Context.Err()
 	}
+}
+
+/*
+finishJob releases the worker that handled the job, once the response has been copied to the user or discarded.
+*/
+func finishJob(httpServer server.HTTPServer, job server.Job, result server.JobResult) {
 
-	return server
-	// else {
-	// 	httph.RWMutex.ReadLock()
+	if result.Response != nil {
+		result.Response.Body.Close()
+	}
+	close(job.Done)
+	httpServer.DecrementActiveJobs()
+	httpServer.ConcurrencyLimiter.Release()
+}
 
-	// 	server1Id := 0
-	// 	server2Id := 0
+/*
+writeResult copies the server's response to the ResponseWriter, or writes an error if the request could not be sent to the server.
+*/
+func (httph *HTTPHandler) writeResult(w http.ResponseWriter, r *http.Request, httpServer server.HTTPServer, result server.JobResult) {
 
-	// 	for server1Id == server2Id {
-	// 		server1Id = rand.IntN(len(httph.HealthyHTTPServerPool))
-	// 		server2Id = rand.IntN(len(httph.HealthyHTTPServerPool))
-	// 	}
+	if result.Err != nil {
+		httph.writeError(w, result.Err)
+		return
+	}
 
-	// 	server1 := httph.HealthyHTTPServerPool[server1Id]
-	// 	server2 := httph.HealthyHTTPServerPool[server2Id]
+	// affinity cookie is sent along with the server's response.
+	httph.AffinityCookie.SetCookie(w.Header(), r, httpServer.Name)
 
-	// 	httph.RWMutex.ReadUnlock()
+	if err := util.CopyResponse(w, result.Response); err != nil {
+		httpServer.Logger.Printf("error while copying response : %s", err.Error())
+	}
+}
 
-	// 	server1.WorkerCountMutex.Lock()
-	// 	server2.WorkerCountMutex.Lock()
+/*
+writeError writes the error response for a request that could not be sent to a server, or did not receive a response.
+Nothing is written if the user cancelled the request, as the user is no longer waiting for a response.
+*/
+func (httph *HTTPHandler) writeError(w http.ResponseWriter, err error) {
 
-	// 	var server server.HTTPServer
+	var opErr *net.OpError
 
-	// 	if *server1.WorkerCount <= *server2.WorkerCount {
-	// 		server = server1
-	// 	} else {
-	// 		server = server2
-	// 	}
+	switch {
 
-	// 	server1.WorkerCountMutex.Unlock()
-	// 	server2.WorkerCountMutex.Unlock()
+	case errors.Is(err, context.Canceled):
+		httph.logger.Printf("request cancelled by user : %s", err.Error())
 
-	// 	httph.logger.Printf("received request %d, forwarded to http server %d", httpRequestId, server.ServerId)
+	case errors.Is(err, errServersOverloaded), errors.Is(err, server.ErrQueueFull), errors.Is(err, server.ErrQueueTimeout):
+		// servers are expected to recover quickly, as the concurrency limit only rejects requests above the current load.
+		w.Header().Set("Retry-After", "1")
+		util.WriteJSON(w, 503, map[string]string{"error": "Service Unavailable."})
 
-	// 	return server
+	// connection failures, including connect timeouts, which also match context.DeadlineExceeded.
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		util.WriteJSON(w, 502, map[string]string{"error": "Bad Gateway."})
 
-	// }
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, server.ErrResponseHeaderTimeout):
+		util.WriteJSON(w, 504, map[string]string{"error": "Gateway Timeout."})
 
+	default:
+		util.WriteJSON(w, 500, map[string]string{"error": "internal server error"})
+	}
 }
 
+/*
+ServeHTTP sends the request to a server selected by the configured algorithm, using a worker of the server.
+Failed requests are retried on a different server according to the retry policy, if the request is idempotent and its body could be buffered.
+Requests with idempotent methods matching a route with hedging enabled are hedged instead.
+*/
 func (httph *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if r.Body == nil {
 		httph.logger.Println("request body is empty.")
 	}
 
-	httpServer := httph.ApplyLoadBalancingAlgorithm()
+	route := server.MatchRoute(httph.Routes, r.URL.Path)
 
-	serverJobChannel := httpServer.JobChannel
+	timeouts := httph.Timeouts
+	if route != nil {
+		timeouts = route.Timeouts
+	}
 
-	/*
-		done channel is used to wait for worker to send request to server, and write response to ResponseWriter.
-		ServeHTTP func needs to wait, as ResponseWriter can only be accessed by Worker go routine without giving superflous error while ServeHTTP func is still in execution.
-	*/
+	// the request timeout applies to every attempt, and to the streaming of the response body.
+	if timeouts.Request > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeouts.Request)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
 
-	doneChannel := make(chan struct{})
+	// the smaller of the per try timeout and response header timeout is used for each attempt.
+	if perTryTimeout := httph.RetryPolicy.PerTryTimeout; perTryTimeout > 0 && (timeouts.ResponseHeader == 0 || perTryTimeout < timeouts.ResponseHeader) {
+		timeouts.ResponseHeader = perTryTimeout
+	}
 
-	/*
-		the following for loop is used to spawn more workers after a timeout.
-		If the maximum number of workers already spawned, then retry deducted.
-		if number of retries reaches 0, then request is not serviced.
+	retryEnabled := httph.RetryPolicy.Enabled() && httph.RetryPolicy.IsRetryable(r)
+	hedgeEnabled := route.HedgingEnabled() && hedgeMethods[r.Method]
 
-	*/
+	// body of the request is buffered, so that it can be sent to more than one server.
+	if retryEnabled || hedgeEnabled {
+		replayable, err := util.BufferRequestBody(r, httph.RetryPolicy.MaxBodySize)
 
-	maxRetries := 5.0
-	retriesLeft := 5.0
+		if err != nil {
+			httph.logger.Printf("error while buffering request body : %s", err.Error())
+			util.WriteJSON(w, 400, map[string]string{"error": "Bad Request."})
+			return
+		}
+		retryEnabled = retryEnabled && replayable
+		hedgeEnabled = hedgeEnabled && replayable
+	}
 
-	for {
+	httph.RetryPolicy.Budget.RecordRequest()
 
-		select {
+	excludedServerIds := make(map[int]bool)
 
-		case serverJobChannel <- server.Job{ResponseWriter: w, Request: r, Done: doneChannel}:
-			<-doneChannel
+	httpServer, permit, err := httph.SelectServer(r, excludedServerIds, true)
+
+	if err != nil {
+		httph.logger.Printf("error while selecting http server : %s", err.Error())
+
+		// overloaded servers, and requests cancelled or timed out while queued.
+		if r.Context().Err() != nil || errors.Is(err, errServersOverloaded) || errors.Is(err, server.ErrQueueFull) || errors.Is(err, server.ErrQueueTimeout) {
+			httph.writeError(w, err)
 			return
+		}
+		util.WriteJSON(w, 503, map[string]string{"error": "Service Unavailable."})
+		return
+	}
 
-		case <-time.After(time.Duration(100*math.Pow(2, maxRetries-retriesLeft)) * time.Millisecond):
+	if hedgeEnabled {
+		httph.serveHedged(w, r, route, timeouts, httpServer, permit, excludedServerIds)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+
+		// used by least-connections and p2c algorithms to find the server with the least load.
+		httpServer.IncrementActiveJobs()
+
+		job := server.InitializeJob(r.Context(), r, timeouts.Connect, timeouts.ResponseHeader)
+		job.CircuitPermit = permit
+
+		if err := httph.SendJob(httpServer, job); err != nil {
+			httpServer.DecrementActiveJobs()
+			releaseServer(httpServer, permit)
+			httph.writeError(w, err)
+			return
+		}
 
-			httpServer.Logger.Printf("attempting to spawn more workers for HTTP server %d...", httpServer.ServerId)
+		// the worker always sends a result, jobs cancelled while queued are dropped by the worker as soon as they are received.
+		result := <-job.Result
 
-			httpServer.WorkerCountMutex.Lock()
+		if retryEnabled && attempt < httph.RetryPolicy.MaxAttempts && r.Context().Err() == nil && httph.RetryPolicy.ShouldRetry(result) {
 
-			if *httpServer.WorkerCount == httpServer.MaxWorkerCount {
+			// retries are always sent to a different server.
+			excludedServerIds[httpServer.ServerId] = true
 
-				retriesLeft--
-				httpServer.Logger.Printf("maximum worker count reached.")
-				if retriesLeft == 0 {
+			nextServer, nextPermit, err := httph.SelectServer(r, excludedServerIds, true)
 
-					util.WriteJSON(w, 429, map[string]string{"error": "Too Many Requests."})
-					httpServer.WorkerCountMutex.Unlock()
-					return
-				}
+			if err != nil {
+				httph.logger.Printf("attempt %d to http server %d failed, no other server available for retry", attempt, httpServer.ServerId)
 
-				httpServer.WorkerCountMutex.Unlock()
+			} else if !httph.RetryPolicy.Budget.AcquireRetry() {
+				releaseServer(nextServer, nextPermit)
+				httph.logger.Printf("attempt %d to http server %d failed, retry budget exhausted", attempt, httpServer.ServerId)
 
 			} else {
-				*httpServer.WorkerCount++
-				workerId := *httpServer.WorkerCount
-				httpServer.WorkerCountMutex.Unlock()
+				httph.logger.Printf("attempt %d to http server %d failed, retrying on http server %d", attempt, httpServer.ServerId, nextServer.ServerId)
+				metrics.AddCounter("proxy_http_retries_total", "number of http requests retried on a different server.", metrics.Labels{"server": strconv.Itoa(httpServer.ServerId)}, 1)
 
-				newWorker := httpServer.SpawnHTTPWorker(workerId, httpServer.MinWorkerCount, httpServer.WorkerTimeout, httpServer.Logger, httpServer.WorkerCount, httpServer.WorkerCountMutex)
+				finishJob(httpServer, job, result)
 
-				go newWorker.ProcessHTTPRequest()
+				r.Body, _ = r.GetBody()
+				httpServer = nextServer
+				permit = nextPermit
+				continue
 			}
-
 		}
-	}
 
+		httph.writeResult(w, r, httpServer, result)
+		finishJob(httpServer, job, result)
+		return
+	}
 }
@@ -0,0 +1,114 @@
+//go:build linux
+
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/loadbalancer"
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/rwmutex"
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/server"
+	"github.com/gookit/ini/v2"
+)
+
+/*
+blackholeAddr returns the address of a listener that never completes new connections, so that connecting to it times out.
+The listener has a backlog of 0, and its only queued connection is never accepted.
+*/
+func blackholeAddr(t *testing.T) string {
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socket returned error : %s", err.Error())
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatalf("bind returned error : %s", err.Error())
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatalf("listen returned error : %s", err.Error())
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("getsockname returned error : %s", err.Error())
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	// fills the backlog of the listener.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial to blackhole returned error : %s", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return addr
+}
+
+func TestConnectTimeoutRetriedOnDifferentServer(t *testing.T) {
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	section := ini.Section{
+		"server1_addr":       blackholeAddr(t),
+		"server2_addr":       strings.TrimPrefix(upstream.URL, "http://"),
+		"retry_max_attempts": "2",
+		"connect_timeout":    "100",
+	}
+
+	pool, err := server.ConfigureHTTPServers(section)
+	if err != nil {
+		t.Fatalf("ConfigureHTTPServers returned error : %s", err.Error())
+	}
+	retryPolicy, err := server.ConfigureRetryPolicy(section, "http")
+	if err != nil {
+		t.Fatalf("ConfigureRetryPolicy returned error : %s", err.Error())
+	}
+	timeouts, err := server.ConfigureTimeouts(section, server.Timeouts{}, "http.")
+	if err != nil {
+		t.Fatalf("ConfigureTimeouts returned error : %s", err.Error())
+	}
+
+	grid := 0
+	httph := &HTTPHandler{
+		HTTPServerPool:        pool,
+		HealthyHTTPServerPool: []server.HTTPServer{},
+		RWMutex:               rwmutex.InitializeReadWriteMutex(),
+		GRIDMutex:             &sync.Mutex{},
+		GlobalRequestId:       &grid,
+		logger:                log.New(io.Discard, "", 0),
+		Algorithm:             "round-robin",
+		SWRR:                  loadbalancer.InitializeSmoothWeightedRoundRobin(),
+		HashRing:              loadbalancer.BuildHashRing(nil),
+		AffinityCookie:        &loadbalancer.AffinityCookie{},
+		RetryPolicy:           retryPolicy,
+		Timeouts:              timeouts,
+	}
+	for _, hs := range httph.HTTPServerPool {
+		hs.Health.SetStatus(server.Healthy, "health checks disabled")
+	}
+	httph.RebuildHealthyServerPool()
+
+	// round-robin sends one of the requests to the blackhole first.
+	for i := 0; i < 2; i++ {
+
+		w := httptest.NewRecorder()
+		httph.ServeHTTP(w, httptest.NewRequest("GET", "http://proxy.example/", nil))
+
+		if w.Code != 200 || w.Body.String() != "ok" {
+			t.Fatalf("request %d got status %d body %q, want 200 \"ok\"", i+1, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/metrics"
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/server"
+)
+
+// methods of requests that can be hedged. Unlike retries, hedging sends the request to two servers at the same time, so it is limited to idempotent methods regardless of retry_methods.
+var hedgeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodTrace:   true,
+}
+
+// hedgedAttempt is one of the copies of a hedged request, sent to a single server.
+type hedgedAttempt struct {
+	server server.HTTPServer
+	job    server.Job
+	cancel context.CancelFunc
+	start  time.Time
+}
+
+type hedgedResult struct {
+	attempt *hedgedAttempt
+	result  server.JobResult
+}
+
+// finish releases the worker that handled the attempt, and cancels the request if it is still being sent.
+func (hr hedgedResult) finish() {
+
+	finishJob(hr.attempt.server, hr.attempt.job, hr.result)
+	hr.attempt.cancel()
+}
+
+/*
+sendHedgedAttempt assigns a copy of the request to a worker of the server, the result is sent on results once it is received.
+Each attempt can be cancelled on its own, and is cancelled along with the user's request.
+Returns an error if the job could not be assigned.
+*/
+func (httph *HTTPHandler) sendHedgedAttempt(r *http.Request, timeouts server.Timeouts, httpServer server.HTTPServer, permit server.CircuitPermit, results chan<- hedgedResult) (*hedgedAttempt, error) {
+
+	ctx, cancel := context.WithCancel(r.Context())
+
+	attempt := &hedgedAttempt{
+		server: httpServer,
+		job:    server.InitializeJob(ctx, r, timeouts.Connect, timeouts.ResponseHeader),
+		cancel: cancel,
+		start:  time.Now(),
+	}
+	attempt.job.CircuitPermit = permit
+
+	httpServer.IncrementActiveJobs()
+
+	if err := httph.SendJob(httpServer, attempt.job); err != nil {
+		cancel()
+		httpServer.DecrementActiveJobs()
+		releaseServer(httpServer, permit)
+		return nil, err
+	}
+
+	go func() {
+		result := <-attempt.job.Result
+		results <- hedgedResult{attempt: attempt, result: result}
+	}()
+
+	return attempt, nil
+}
+
+/*
+serveHedged sends the request to httpServer, and sends a copy of the request to a different server if no response is received within the hedge delay of the route.
+The first successful response is copied to the user, and the other request is cancelled.
+If the first response is a failure (according to the retry policy), the response of the other request is awaited instead.
+Hedged requests count towards the retry budget, and are not retried.
+*/
+func (httph *HTTPHandler) serveHedged(w http.ResponseWriter, r *http.Request, route *server.Route, timeouts server.Timeouts, httpServer server.HTTPServer, permit server.CircuitPermit, excludedServerIds map[int]bool) {
+
+	routeLabels := metrics.Labels{"route": strconv.Itoa(route.RouteId)}
+	metrics.AddCounter("proxy_http_hedge_eligible_requests_total", "number of http requests that could be hedged.", routeLabels, 1)
+
+	// buffered, so that results of attempts that lost are not blocked.
+	results := make(chan hedgedResult, 2)
+
+	primary, err := httph.sendHedgedAttempt(r, timeouts, httpServer, permit, results)
+
+	if err != nil {
+		httph.writeError(w, err)
+		return
+	}
+
+	outstanding := 1
+
+	var hedgeTimer <-chan time.Time
+	if delay, ok := route.GetHedgeDelay(); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+
+	var hedge *hedgedAttempt
+	var failed *hedgedResult // failed result, kept in case the other request also fails.
+
+	for {
+		select {
+
+		case <-hedgeTimer:
+			hedgeTimer = nil
+
+			excludedServerIds[primary.server.ServerId] = true
+			// hedged requests are not queued, as results of the original request are not received while waiting.
+			nextServer, nextPermit, err := httph.SelectServer(r, excludedServerIds, false)
+
+			if err != nil {
+				httph.logger.Printf("no other server available to hedge request to http server %d", primary.server.ServerId)
+				continue
+			}
+			if !httph.RetryPolicy.Budget.AcquireRetry() {
+				releaseServer(nextServer, nextPermit)
+				httph.logger.Printf("request to http server %d not hedged, retry budget exhausted", primary.server.ServerId)
+				continue
+			}
+
+			// each copy of the request reads its own copy of the buffered body.
+			hedgeRequest := r.Clone(r.Context())
+			hedgeRequest.Body, _ = r.GetBody()
+
+			if hedge, err = httph.sendHedgedAttempt(hedgeRequest, timeouts, nextServer, nextPermit, results); err == nil {
+				outstanding++
+				httph.logger.Printf("no response from http server %d after %s, hedging request to http server %d", primary.server.ServerId, time.Since(primary.start), nextServer.ServerId)
+				metrics.AddCounter("proxy_http_hedged_requests_total", "number of hedged http requests sent.", routeLabels, 1)
+			}
+
+		case res := <-results:
+			outstanding--
+
+			if outstanding > 0 && httph.RetryPolicy.ShouldRetry(res.result) {
+				failed = &res
+				continue
+			}
+			// no need to send a hedged request once a response has been received.
+			hedgeTimer = nil
+
+			if failed != nil {
+				failed.finish()
+			}
+
+			// the other request lost, it is cancelled and its worker is released once it returns.
+			if outstanding > 0 {
+				loser := primary
+				if res.attempt == primary {
+					loser = hedge
+				}
+				loser.cancel()
+				go func() {
+					(<-results).finish()
+				}()
+			}
+
+			if hedge != nil && res.attempt == hedge {
+				metrics.AddCounter("proxy_http_hedge_wins_total", "number of hedged http requests that responded before the original request.", routeLabels, 1)
+			}
+			// only the latency of the original request is recorded, measured from its start even if the hedged request won,
+			// as latencies of hedged requests would lower the hedge delay, causing more requests to be hedged.
+			if res.result.Err == nil {
+				route.Latency.Record(time.Since(primary.start))
+			}
+
+			httph.writeResult(w, r, res.attempt.server, res.result)
+			res.finish()
+			return
+		}
+	}
+}
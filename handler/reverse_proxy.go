@@ -1,12 +1,17 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/metrics"
 	"github.com/Adarsh-Kmt/WebsocketReverseProxy/util"
 	"github.com/gookit/ini/v2"
 )
@@ -19,6 +24,9 @@ type ReverseProxy struct {
 	Addr             string
 	WebsocketHandler http.Handler
 	HTTPHandler      http.Handler
+	TrustedProxies   []*net.IPNet  // forwarding headers sent by these proxies are kept, instead of being overwritten.
+	MetricsPath      string        // if not empty, metrics of the proxy are served at this path instead of being forwarded to a server.
+	ShutdownTimeout  time.Duration // maximum time to wait for connections and websocket sessions to end, when the proxy shuts down.
 	logger           *log.Logger
 }
 
@@ -54,6 +62,27 @@ func ConfigureReverseProxy() (*ReverseProxy, error) {
 	}
 
 	addr := host + ":" + port
+
+	trustedProxies, err := util.ParseTrustedProxies(cfg.String("frontend.trusted_proxies"))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid config, frontend.trusted_proxies should be a comma separated list of CIDRs : %s", err.Error())
+	}
+	metricsPath := cfg.String("frontend.metrics_path")
+
+	if metricsPath != "" && !strings.HasPrefix(metricsPath, "/") {
+		return nil, fmt.Errorf("invalid config, frontend.metrics_path should start with /")
+	}
+
+	shutdownTimeout := 10000
+
+	if timeoutString := cfg.String("frontend.shutdown_drain_timeout"); timeoutString != "" {
+		shutdownTimeout, err = strconv.Atoi(timeoutString)
+		if err != nil || shutdownTimeout < 0 {
+			return nil, fmt.Errorf("invalid config, frontend.shutdown_drain_timeout should be a valid non negative integer (milliseconds)")
+		}
+	}
+
 	logger.Println("load balancer listening on address : " + addr)
 	var wsHandler http.Handler
 
@@ -74,6 +103,9 @@ func ConfigureReverseProxy() (*ReverseProxy, error) {
 		Addr:             addr,
 		WebsocketHandler: wsHandler,
 		HTTPHandler:      httpHandler,
+		TrustedProxies:   trustedProxies,
+		MetricsPath:      metricsPath,
+		ShutdownTimeout:  time.Duration(shutdownTimeout) * time.Millisecond,
 		logger:           logger,
 	}
 
@@ -83,6 +115,14 @@ func ConfigureReverseProxy() (*ReverseProxy, error) {
 
 func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	if rp.MetricsPath != "" && r.URL.Path == rp.MetricsPath {
+		metrics.Handler().ServeHTTP(w, r)
+		return
+	}
+
+	util.SetForwardingHeaders(r, rp.TrustedProxies)
+	r = util.WithClientIP(r, rp.TrustedProxies)
+
 	if r.Header.Get("Connection") == "Upgrade" && r.Header.Get("Upgrade") == "websocket" {
 
 		// if config has missing [websocket] section, websocketHandler should not be created.
@@ -100,6 +140,18 @@ func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+Shutdown drains the websocket sessions of the proxy, waiting until they end or ctx is done.
+It should be called along with http.Server.Shutdown, which does not track hijacked websocket connections.
+*/
+func (rp *ReverseProxy) Shutdown(ctx context.Context) error {
+
+	if wh, ok := rp.WebsocketHandler.(*WebsocketHandler); ok {
+		return wh.Shutdown(ctx)
+	}
+	return nil
+}
+
 // Connection state logger
 func (rp *ReverseProxy) LogConnState(conn net.Conn, state http.ConnState) {
 	switch state {
@@ -1,23 +1,23 @@
 package handler
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 
 	"sync"
 	"time"
 
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/loadbalancer"
 	"github.com/Adarsh-Kmt/WebsocketReverseProxy/rwmutex"
 	"github.com/Adarsh-Kmt/WebsocketReverseProxy/server"
-	"github.com/Adarsh-Kmt/WebsocketReverseProxy/types"
 
 	"github.com/Adarsh-Kmt/WebsocketReverseProxy/util"
 	"github.com/gookit/ini/v2"
@@ -32,14 +32,30 @@ type WebsocketHandler struct {
 	HWSPMutex    *sync.Mutex     // mutex used to write to healthy end server pool.
 	TWSWaitGroup *sync.WaitGroup // wait group for TestServer go routines.
 
+	SWRR *loadbalancer.SmoothWeightedRoundRobin // state of weighted-round-robin algorithm.
+
+	HashRing        *loadbalancer.HashRing // hash ring of healthy servers, used by consistent-hash algorithm.
+	HashKeySource   loadbalancer.HashKeySource
+	HashBoundedLoad float64 // if greater than 0, servers with load greater than HashBoundedLoad times the average load are skipped.
+
+	AffinityCookie *loadbalancer.AffinityCookie // if enabled, users are pinned to the server that handled their first request.
+
+	Relay            util.RelayConfig           // decides how frames are relayed between users and servers.
+	Dial             server.WebsocketDialConfig // decides how websocket connections are established with servers.
+	SessionDrain     server.SessionDrainConfig  // decides how open sessions of a server are closed, once it becomes unhealthy or draining.
+	HandshakeHeaders util.HandshakeHeaderPolicy // decides which headers of the user's handshake request are sent to the server.
+	AllowedOrigins   util.OriginPolicy          // decides which origins users can open websocket connections from.
+	ShutdownCode     int                        // close code sent to both sides of every session when the proxy shuts down.
+
+	shuttingDown  bool            // true once Shutdown is called, new connection attempts are rejected.
+	activeConns   *sync.WaitGroup // connection attempts and open sessions, waited for by Shutdown.
+	shutdownMutex *sync.Mutex     // mutex used to start connection attempts and Shutdown.
+
 	GlobalConnectionId *int
 	GCIDMutex          *sync.Mutex // mutex for updating the global connection ID.
 
 	healthCheckClient http.Client
 
-	HealthyServerIdChannel   chan int
-	UnhealthyServerIdChannel chan int
-
 	/*
 		reader-writer mutex used to provide synchronization between HealthCheck go routine (writer) and ConnectUser go routines (readers)
 	*/
@@ -48,6 +64,9 @@ type WebsocketHandler struct {
 	logger *log.Logger
 }
 
+// returned by DialServer when no healthy websocket server can be selected.
+var errNoWebsocketServers = errors.New("no websocket servers available")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -105,13 +124,63 @@ func ConfigureWebsocketHandler() (http.Handler, error) {
 
 	if algo := cfg.String("websocket.algorithm"); algo != "" {
 
-		if algo != "round-robin" && algo != "random" {
-			return nil, fmt.Errorf("format for websocket section:\n\n[websocket]\nalgorithm={round-robin/random}")
+		if !loadbalancer.IsValidAlgorithm(algo) {
+			return nil, fmt.Errorf("format for websocket section:\n\n[websocket]\nalgorithm=%s", loadbalancer.AlgorithmsFormat())
 		}
 		algorithm = algo
 
 	}
 
+	hashKeySource, err := loadbalancer.ParseHashKeySource(cfg.String("websocket.hash_key"))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid config, websocket.%s", err.Error())
+	}
+
+	hashBoundedLoad := 0.0
+
+	if boundedLoadString := cfg.String("websocket.hash_bounded_load"); boundedLoadString != "" {
+		hashBoundedLoad, err = strconv.ParseFloat(boundedLoadString, 64)
+		if err != nil || hashBoundedLoad < 1 {
+			return nil, fmt.Errorf("invalid config, websocket.hash_bounded_load should be a number greater than or equal to 1")
+		}
+	}
+
+	affinityCookie := &loadbalancer.AffinityCookie{
+		Name:   cfg.String("frontend.affinity_cookie"),
+		Secret: []byte(cfg.String("frontend.affinity_secret")),
+	}
+
+	relay, err := server.ConfigureWebsocketRelay(ws, "websocket")
+
+	if err != nil {
+		return nil, err
+	}
+
+	dial, err := server.ConfigureWebsocketDial(ws, "websocket")
+
+	if err != nil {
+		return nil, err
+	}
+
+	sessionDrain, err := server.ConfigureSessionDrain(ws, "websocket")
+
+	if err != nil {
+		return nil, err
+	}
+
+	allowedOrigins, err := server.ConfigureAllowedOrigins(ws, "websocket")
+
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownCode, err := server.ParseCloseCode(cfg.Section("frontend"), "shutdown_close_code", "frontend")
+
+	if err != nil {
+		return nil, err
+	}
+
 	gcid := 0
 	lg := log.New(os.Stdout, "WEBSOCKET_HANDLER : ", 0)
 	wh := &WebsocketHandler{
@@ -124,18 +193,26 @@ func ConfigureWebsocketHandler() (http.Handler, error) {
 		GlobalConnectionId:         &gcid,
 		logger:                     lg,
 		healthCheckClient:          util.InitializeHandlerHTTPClient(lg),
-		HealthyServerIdChannel:     make(chan int),
-		UnhealthyServerIdChannel:   make(chan int),
 		Algorithm:                  algorithm,
+		SWRR:                       loadbalancer.InitializeSmoothWeightedRoundRobin(),
+		HashRing:                   loadbalancer.BuildHashRing(nil),
+		HashKeySource:              hashKeySource,
+		HashBoundedLoad:            hashBoundedLoad,
+		AffinityCookie:             affinityCookie,
+		Relay:                      relay,
+		Dial:                       dial,
+		SessionDrain:               sessionDrain,
+		ShutdownCode:               shutdownCode,
+		activeConns:                &sync.WaitGroup{},
+		shutdownMutex:              &sync.Mutex{},
+		HandshakeHeaders:           server.ConfigureHandshakeHeaders(ws),
+		AllowedOrigins:             allowedOrigins,
 	}
 
 	periodicFunc := func(healthCheckInterval int) {
 
 		for {
-			wg := &sync.WaitGroup{}
-			wg.Add(1)
-			wh.HealthCheck(wg)
-			wg.Wait()
+			wh.HealthCheck()
 			time.Sleep(time.Duration(healthCheckInterval) * time.Second)
 		}
 	}
@@ -143,93 +220,112 @@ func ConfigureWebsocketHandler() (http.Handler, error) {
 	if healthCheckEnabled {
 		go periodicFunc(healthCheckInterval)
 	} else {
-		wh.HealthyWebsocketServerPool = make([]server.WebsocketServer, len(wh.WebsocketServerPool))
-		copy(wh.HealthyWebsocketServerPool, wh.WebsocketServerPool)
+		// without health checks, every server is considered healthy.
+		for _, ws := range wh.WebsocketServerPool {
+			ws.Health.SetStatus(server.Healthy, "health checks disabled")
+		}
+		wh.RebuildHealthyServerPool()
 	}
 
 	return wh, nil
 
 }
 
-func (wh *WebsocketHandler) HealthCheck(wg *sync.WaitGroup) {
+/*
+HealthCheck checks all servers concurrently, updates the health state of each server, and rebuilds the healthy server pool.
+*/
+func (wh *WebsocketHandler) HealthCheck() {
+
+	wg := &sync.WaitGroup{}
 
-	defer wg.Done()
-	hwsPool := make([]server.WebsocketServer, 0, len(wh.WebsocketServerPool))
-	hwsIdPool := make([]int, 0)
 	for _, es := range wh.WebsocketServerPool {
 
-		go wh.TestWebsocketServer(es)
+		wg.Add(1)
+		go func(es server.WebsocketServer) {
+			defer wg.Done()
+			wh.TestWebsocketServer(es)
+		}(es)
 	}
 
-	serversResponded := 0
+	wg.Wait()
 
-	for serversResponded != len(wh.WebsocketServerPool) {
-
-		select {
+	wh.RebuildHealthyServerPool()
+}
 
-		case serverId := <-wh.HealthyServerIdChannel:
-			//hesPool = append(hesPool, wh.WebsocketServerPool[serverId-1])
-			hwsIdPool = append(hwsIdPool, serverId)
-			serversResponded++
+/*
+RebuildHealthyServerPool builds the healthy server pool using the health state of each server.
+servers with weight 0 are kept out of rotation.
+The pool is only replaced if the set of healthy servers has changed.
+*/
+func (wh *WebsocketHandler) RebuildHealthyServerPool() {
 
-		case <-wh.UnhealthyServerIdChannel:
-			serversResponded++
+	hwsPool := make([]server.WebsocketServer, 0, len(wh.WebsocketServerPool))
 
+	for _, ws := range wh.WebsocketServerPool {
+		if ws.Health.Status() == server.Healthy && ws.Weight > 0 {
+			hwsPool = append(hwsPool, ws)
 		}
+	}
 
+	wh.RWMutex.ReadLock()
+	changed := len(hwsPool) != len(wh.HealthyWebsocketServerPool)
+	for index := 0; !changed && index < len(hwsPool); index++ {
+		changed = hwsPool[index].ServerId != wh.HealthyWebsocketServerPool[index].ServerId
 	}
+	wh.RWMutex.ReadUnlock()
 
-	if wh.Algorithm == "round-robin" {
-		sort.Ints(hwsIdPool)
+	if changed {
+		wh.logger.Printf("size of healthy websocket server pool : %d", len(hwsPool))
+		wh.UpdateHealthyServerPool(hwsPool)
 	}
-	wh.logger.Printf("length of healthy server id list : %d", len(hwsIdPool))
-	for serverId := range hwsIdPool {
-		hwsPool = append(hwsPool, wh.WebsocketServerPool[serverId])
+}
+
+/*
+UpdateHealthyServerPool replaces the healthy server pool, and rebuilds the hash ring used by consistent-hash algorithm.
+*/
+func (wh *WebsocketHandler) UpdateHealthyServerPool(hwsPool []server.WebsocketServer) {
+
+	members := make([]loadbalancer.RingMember, 0, len(hwsPool))
+	for _, ws := range hwsPool {
+		members = append(members, loadbalancer.RingMember{ServerId: ws.ServerId, Addr: ws.Addr, Weight: ws.Weight})
 	}
-	//wh.logger.Println("finished health check.")
-	//wh.logger.Printf("length of the healthy http server list after health check: %d", len(hesPool))
+	hashRing := loadbalancer.BuildHashRing(members)
 
 	wh.RWMutex.WriteLock()
 	wh.HealthyWebsocketServerPool = hwsPool
+	wh.HashRing = hashRing
 
 	wh.RWMutex.WriteUnlock()
-
 }
 
 /*
-go routine used to check wether a server is online, then writes to HealthyServerId channel or UnhealthyServerId channel.
+TestWebsocketServer checks wether a server is online, and records the result in the health state of the server.
+Changes in health state are logged. If session draining is enabled, open sessions of a server that stops being healthy are drained.
 */
 func (wh *WebsocketHandler) TestWebsocketServer(s server.WebsocketServer) {
 
-	response, err := wh.healthCheckClient.Get(fmt.Sprintf("http://" + s.Addr + "/healthCheck"))
+	err := s.HealthCheck.Check(&wh.healthCheckClient, s.Addr)
 
 	if err != nil {
 		wh.logger.Println(s.Addr + " health check error: " + err.Error())
-		wh.UnhealthyServerIdChannel <- s.ServerId
-		return
 	}
 
-	var hcr types.HealthCheckResponse
-	respBody, err := io.ReadAll(response.Body)
-	response.Body.Close()
-	json.Unmarshal(respBody, &hcr)
+	if transition, changed := s.Health.RecordCheck(err); changed {
+		s.Logger.Println(transition.String())
 
-	if err != nil {
-		wh.logger.Println("error while json decoding health check response: " + err.Error())
-		wh.UnhealthyServerIdChannel <- s.ServerId
-		return
-	}
-	//wh.logger.Printf("response status received from %s : %d\n", s.Addr, hcr.Status)
-
-	if hcr.Status == 200 {
-		wh.HealthyServerIdChannel <- s.ServerId
-	} else {
-		wh.UnhealthyServerIdChannel <- s.ServerId
+		if wh.SessionDrain.Enabled && (transition.To == server.Unhealthy || transition.To == server.Draining) {
+			go s.DrainSessions(wh.SessionDrain)
+		}
 	}
-
 }
 
-func (wh *WebsocketHandler) ApplyLoadBalancingAlgorithm() server.WebsocketServer {
+/*
+ApplyLoadBalancingAlgorithm selects a server from the healthy server pool, using the configured algorithm.
+If the request has an affinity cookie pinning it to a healthy server, that server is selected instead.
+Servers in excludedServerIds are never selected.
+Returns an error if there are no healthy servers that can be selected.
+*/
+func (wh *WebsocketHandler) ApplyLoadBalancingAlgorithm(r *http.Request, excludedServerIds map[int]bool) (server.WebsocketServer, error) {
 
 	wh.GCIDMutex.Lock()
 	*wh.GlobalConnectionId++
@@ -238,98 +334,360 @@ func (wh *WebsocketHandler) ApplyLoadBalancingAlgorithm() server.WebsocketServer
 	serverWebsocketConnId := *wh.GlobalConnectionId
 	wh.GCIDMutex.Unlock()
 
-	var server server.WebsocketServer
-	if wh.Algorithm == "round-robin" || wh.Algorithm == "random" {
+	wh.logger.Printf("websocket server websocket connection id %d\n", serverWebsocketConnId)
+	wh.logger.Printf("user websocket connection id %d\n", userWebsocketConnId)
 
-		wh.logger.Printf("websocket server websocket connection id %d\n", serverWebsocketConnId)
-		wh.logger.Printf("user websocket connection id %d\n", userWebsocketConnId)
+	wh.RWMutex.ReadLock()
+	defer wh.RWMutex.ReadUnlock()
 
-		wh.RWMutex.ReadLock()
+	healthyPool := wh.HealthyWebsocketServerPool
 
-		serverId := serverWebsocketConnId % len(wh.HealthyWebsocketServerPool)
-		server = wh.HealthyWebsocketServerPool[serverId]
+	if len(healthyPool) == 0 {
+		return server.WebsocketServer{}, fmt.Errorf("no healthy websocket servers available")
+	}
 
-		wh.logger.Printf("user connected to server %s", server.Addr)
+	candidates := make([]server.WebsocketServer, 0, len(healthyPool))
 
-		wh.RWMutex.ReadUnlock()
+	for _, s := range healthyPool {
+		if !excludedServerIds[s.ServerId] {
+			candidates = append(candidates, s)
+		}
+	}
 
+	if len(candidates) == 0 {
+		return server.WebsocketServer{}, fmt.Errorf("no websocket servers available, %d healthy servers excluded", len(healthyPool))
 	}
-	return server
-	// else {
 
-	// 	wh.RWMutex.ReadLock()
+	// servers temporarily taken out of the pool (eg: ejected by outlier detection) are skipped, unless every candidate has been taken out.
+	pool := make([]server.WebsocketServer, 0, len(candidates))
+	availableServerIds := make(map[int]bool, len(candidates))
 
-	// 	server1Id := 0
-	// 	server2Id := 0
+	for _, s := range candidates {
+		if s.IsAvailable() {
+			pool = append(pool, s)
+			availableServerIds[s.ServerId] = true
+		}
+	}
+
+	if len(pool) == 0 {
+		pool = candidates
+		for _, s := range candidates {
+			availableServerIds[s.ServerId] = true
+		}
+	}
 
-	// 	for server1Id == server2Id {
-	// 		server1Id = rand.IntN(len(wh.HealthyWebsocketServerPool))
-	// 		server2Id = rand.IntN(len(wh.HealthyWebsocketServerPool))
-	// 	}
+	if identity, ok := wh.AffinityCookie.PinnedServer(r); ok {
+		for _, ws := range pool {
+			if loadbalancer.ServerIdentity(ws.Name) == identity {
+				wh.logger.Printf("user connected to pinned server %s", ws.Addr)
+				return ws, nil
+			}
+		}
+	}
 
-	// 	server1 := wh.HealthyWebsocketServerPool[server1Id]
-	// 	server2 := wh.HealthyWebsocketServerPool[server2Id]
+	// fraction of its full weight received by each server, less than 1 for servers in slow start.
+	slowStartFactors := make(map[int]float64, len(pool))
+	for _, s := range pool {
+		slowStartFactors[s.ServerId] = s.SlowStartFactor()
+	}
 
-	// 	wh.RWMutex.ReadUnlock()
+	slowStartFactor := func(index int) float64 {
+		return slowStartFactors[pool[index].ServerId]
+	}
 
-	// 	server1.NumConnMutex.Lock()
-	// 	server2.NumConnMutex.Lock()
+	// load of servers in slow start is scaled up, so that they receive fewer connections.
+	numConns := func(index int) float64 {
+		return float64(pool[index].GetNumConns()+1) / slowStartFactor(index)
+	}
 
-	// 	var server server.WebsocketServer
+	var serverIndex int
 
-	// 	if *server1.NumConns <= *server2.NumConns {
-	// 		server = server1
-	// 	} else {
-	// 		server = server2
-	// 	}
+	switch wh.Algorithm {
 
-	// 	server1.NumConnMutex.Unlock()
-	// 	server2.NumConnMutex.Unlock()
+	case loadbalancer.RoundRobin:
+		// connection ids are incremented by 2 for each user.
+		serverIndex = loadbalancer.SelectRoundRobin(len(pool), serverWebsocketConnId/2, slowStartFactor)
 
-	// 	//wh.logger.Printf("received request %d, forwarded to http server %d", httpRequestId, server.ServerId)
+	case loadbalancer.Random:
+		serverIndex = loadbalancer.SelectRandom(len(pool), slowStartFactor)
 
-	// 	return server
-	// }
+	case loadbalancer.LeastConnections:
+		serverIndex = loadbalancer.SelectLeastConnections(len(pool), serverWebsocketConnId/2, numConns)
 
+	case loadbalancer.PowerOfTwo:
+		serverIndex = loadbalancer.SelectPowerOfTwoChoices(len(pool), numConns)
+
+	case loadbalancer.WeightedRR:
+		serverIndex = wh.SWRR.Select(len(pool), func(index int) int { return pool[index].ServerId }, func(index int) float64 { return float64(pool[index].Weight) * slowStartFactor(index) })
+
+	case loadbalancer.ConsistentHash:
+		serverId := wh.HashRing.Select(
+			wh.HashKeySource.Extract(r),
+			wh.HashBoundedLoad,
+			func(serverId int) int { return wh.WebsocketServerPool[serverId-1].GetNumConns() },
+			func(serverId int) bool { return availableServerIds[serverId] },
+			func(serverId int) float64 { return slowStartFactors[serverId] },
+		)
+		for index := range pool {
+			if pool[index].ServerId == serverId {
+				serverIndex = index
+			}
+		}
+	}
+
+	server := pool[serverIndex]
+	wh.logger.Printf("user connected to server %s", server.Addr)
+
+	return server, nil
+}
+
+/*
+DialServer establishes a websocket connection with a server selected by the configured algorithm.
+If the connection cannot be established (eg: connection refused, handshake timeout), it is attempted with a different healthy server,
+up to the maximum number of connect attempts. Handshakes rejected by a server are not attempted again, and the server's response is returned along with the error.
+*/
+func (wh *WebsocketHandler) DialServer(r *http.Request) (server.WebsocketServer, *websocket.Conn, *http.Response, error) {
+
+	// subprotocols requested by the user are offered to the server, which selects one of them.
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = websocket.Subprotocols(r)
+	dialer.HandshakeTimeout = wh.Dial.HandshakeTimeout
+
+	header := util.InitializeHeaders(r, wh.HandshakeHeaders)
+	excludedServerIds := make(map[int]bool)
+
+	var err error
+
+	for attempt := 1; attempt <= wh.Dial.MaxAttempts; attempt++ {
+
+		websocketServer, selectErr := wh.ApplyLoadBalancingAlgorithm(r, excludedServerIds)
+
+		if selectErr != nil {
+			// the error of the last connect attempt is returned, if a connection was attempted.
+			if err == nil {
+				err = fmt.Errorf("%w : %s", errNoWebsocketServers, selectErr.Error())
+			}
+			break
+		}
+
+		// connection is counted as soon as the server is selected, so that concurrent connection attempts are spread across servers by least-connections and p2c algorithms.
+		websocketServer.IncrementNumConns()
+
+		url := url.URL{Scheme: "ws", Host: websocketServer.Addr, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+
+		var serverConn *websocket.Conn
+		var dialResponse *http.Response
+
+		serverConn, dialResponse, err = dialer.DialContext(r.Context(), url.String(), header)
+
+		if err == nil {
+			websocketServer.OutlierDetector.RecordOutcome(websocketServer.ServerId, server.Success)
+			return websocketServer, serverConn, dialResponse, nil
+		}
+
+		wh.logger.Printf("error while establishing server websocket connection with address %s (attempt %d) : %s ", websocketServer.Addr, attempt, err.Error())
+		websocketServer.DecrementNumConns()
+
+		// a rejected handshake is only counted as a failure if the server responded with a 5xx status code.
+		if dialResponse != nil {
+			websocketServer.OutlierDetector.RecordOutcome(websocketServer.ServerId, server.ClassifyStatus(dialResponse.StatusCode))
+			return websocketServer, nil, dialResponse, err
+		}
+		websocketServer.OutlierDetector.RecordOutcome(websocketServer.ServerId, server.ClassifyError(err))
+
+		if r.Context().Err() != nil {
+			break
+		}
+		excludedServerIds[websocketServer.ServerId] = true
+	}
+
+	return server.WebsocketServer{}, nil, nil, err
+}
+
+/*
+writeDialError writes the error response for a user whose websocket connection could not be established with a server.
+Handshakes rejected by the server are answered with the server's response (eg: 401, 403), so that users can tell them apart from outages.
+Nothing is written if the user cancelled the request.
+*/
+func (wh *WebsocketHandler) writeDialError(w http.ResponseWriter, r *http.Request, dialResponse *http.Response, err error) {
+
+	var netErr net.Error
+
+	switch {
+
+	// a 101 response is only returned along with an error if it is invalid (eg: wrong Sec-Websocket-Accept).
+	case dialResponse != nil && dialResponse.StatusCode != http.StatusSwitchingProtocols:
+		if err := util.CopyHandshakeRejection(w, dialResponse); err != nil {
+			wh.logger.Printf("error while copying handshake rejection : %s", err.Error())
+		}
+
+	case r.Context().Err() != nil:
+		wh.logger.Printf("connection attempt cancelled by user : %s", err.Error())
+
+	case errors.Is(err, errNoWebsocketServers):
+		util.WriteJSON(w, 503, map[string]string{"error": "Service Unavailable.", "reason": "no websocket servers available"})
+
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		util.WriteJSON(w, 504, map[string]string{"error": "Gateway Timeout.", "reason": "websocket handshake with server timed out"})
+
+	case dialResponse != nil:
+		util.WriteJSON(w, 502, map[string]string{"error": "Bad Gateway.", "reason": "invalid websocket handshake response from server"})
+
+	default:
+		util.WriteJSON(w, 502, map[string]string{"error": "Bad Gateway.", "reason": "websocket server unreachable"})
+	}
 }
 
 /*
 ServeHTTP func used to handle user connection attempts.
-spawns 2 go routines:
+starts a relay session, which spawns 2 go routines:
 
-1) StartListeningToServer : listens to ws server websocket connection, writes to user websocket connection.
-2) StartListeningToUser		 : listens to user websocket connection, writes to ws server websocket connection.
+1) listens to ws server websocket connection, writes to user websocket connection.
+2) listens to user websocket connection, writes to ws server websocket connection.
 */
 
 func (wh *WebsocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	wh.logger.Printf("received %s request, path %s", r.Method, r.URL.Path)
 
-	websocketServer := wh.ApplyLoadBalancingAlgorithm()
+	if !wh.startConn() {
+		util.WriteJSON(w, 503, map[string]string{"error": "Service Unavailable.", "reason": "proxy is shutting down"})
+		return
+	}
 
-	url := url.URL{Scheme: "ws", Host: websocketServer.Addr, Path: r.URL.Path}
+	// cross origin requests are rejected before connecting to a server, unless their origin is allowed.
+	if !wh.AllowedOrigins.Check(r) {
+		wh.logger.Printf("rejected websocket connection from origin %s", r.Header.Get("Origin"))
+		util.WriteJSON(w, 403, map[string]string{"error": "Forbidden.", "reason": "origin not allowed"})
+		wh.activeConns.Done()
+		return
+	}
 
-	header := util.InitializeHeaders(r)
-	WSServerWebsocketConn, _, err := websocket.DefaultDialer.Dial(url.String(), header)
+	websocketServer, WSServerWebsocketConn, dialResponse, err := wh.DialServer(r)
 
 	if err != nil {
-
-		wh.logger.Printf("error while establishing server websocket connection with address %s : %s ", websocketServer.Addr, err.Error())
-		util.WriteJSON(w, 500, map[string]string{"error": "internal server error"})
+		wh.logger.Printf("error while connecting user to websocket server : %s", err.Error())
+		wh.writeDialError(w, r, dialResponse, err)
+		wh.activeConns.Done()
 		return
 	}
-	userWebsocketConn, err := upgrader.Upgrade(w, r, nil)
+
+	// headers of the server's handshake response (eg: Set-Cookie) and the affinity cookie are sent along with the 101 Switching Protocols response.
+	responseHeader := util.HandshakeResponseHeaders(dialResponse)
+	wh.AffinityCookie.SetCookie(responseHeader, r, websocketServer.Name)
+
+	// the subprotocol selected by the server is the only one accepted from the user.
+	userUpgrader := upgrader
+	if subprotocol := WSServerWebsocketConn.Subprotocol(); subprotocol != "" {
+		userUpgrader.Subprotocols = []string{subprotocol}
+	}
+	userUpgrader.CheckOrigin = wh.AllowedOrigins.Check
+
+	userWebsocketConn, err := userUpgrader.Upgrade(w, r, responseHeader)
 
 	if err != nil {
 		wh.logger.Printf("error while upgrading user websocket connection: %s ", err.Error())
-		util.WriteJSON(w, 500, map[string]string{"error": "internal server error"})
+		WSServerWebsocketConn.Close()
+		websocketServer.DecrementNumConns()
+		wh.activeConns.Done()
 		return
 
 	}
 
-	go util.StartListeningToServer(userWebsocketConn, WSServerWebsocketConn, websocketServer.Logger)
-	go util.StartListeningToUser(userWebsocketConn, WSServerWebsocketConn, websocketServer.Logger)
+	session := util.InitializeRelaySession(userWebsocketConn, WSServerWebsocketConn, wh.Relay, websocketServer.Logger)
+	websocketServer.Sessions.Add(session)
+	session.Start()
+
+	// sessions registered after Shutdown listed the open sessions are closed here instead.
+	if wh.isShuttingDown() {
+		session.Close(wh.ShutdownCode, "proxy shutting down", "proxy_shutdown")
+	}
+
+	// connection is no longer counted once the session has ended.
+	go func() {
+		<-session.Done()
+		websocketServer.Sessions.Remove(session)
+		websocketServer.DecrementNumConns()
+		wh.activeConns.Done()
+	}()
 
 	wh.logger.Printf("responded to request")
 
 }
+
+/*
+startConn counts a connection attempt as active, so that Shutdown waits for it and for its session, unless the proxy is shutting down.
+Connection attempts are counted under the same mutex that Shutdown uses, so none is counted after Shutdown starts waiting.
+Returns false if the proxy is shutting down.
+*/
+func (wh *WebsocketHandler) startConn() bool {
+
+	wh.shutdownMutex.Lock()
+	defer wh.shutdownMutex.Unlock()
+
+	if wh.shuttingDown {
+		return false
+	}
+	wh.activeConns.Add(1)
+	return true
+}
+
+func (wh *WebsocketHandler) isShuttingDown() bool {
+
+	wh.shutdownMutex.Lock()
+	defer wh.shutdownMutex.Unlock()
+	return wh.shuttingDown
+}
+
+/*
+Shutdown rejects new connection attempts, and sends a close frame with the shutdown close code to both sides of every open session.
+It waits for the sessions to end, including sessions of connection attempts in progress, which are closed once they start,
+or until ctx is done, after which the connections of the remaining sessions are closed immediately.
+http.Server.Shutdown does not track hijacked connections, so websocket sessions must be drained using Shutdown.
+*/
+func (wh *WebsocketHandler) Shutdown(ctx context.Context) error {
+
+	wh.shutdownMutex.Lock()
+	wh.shuttingDown = true
+	wh.shutdownMutex.Unlock()
+
+	sessions := make([]*util.RelaySession, 0)
+	for _, ws := range wh.WebsocketServerPool {
+		sessions = append(sessions, ws.Sessions.List()...)
+	}
+
+	wh.logger.Printf("shutting down, closing %d websocket sessions", len(sessions))
+
+	// close frames are sent concurrently, as Close blocks on writes to both sides of a session, so that slow peers cannot delay the drain past ctx.
+	for _, session := range sessions {
+		go session.Close(wh.ShutdownCode, "proxy shutting down", "proxy_shutdown")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wh.activeConns.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		wh.logger.Println("all websocket sessions closed")
+		return nil
+	case <-ctx.Done():
+	}
+
+	// sessions are listed again, as sessions started after the first listing are not in sessions.
+	remaining := 0
+	for _, ws := range wh.WebsocketServerPool {
+		for _, session := range ws.Sessions.List() {
+			select {
+			case <-session.Done():
+			default:
+				remaining++
+				session.Terminate()
+			}
+		}
+	}
+	wh.logger.Printf("drain timeout exceeded, terminated %d websocket sessions", remaining)
+	return ctx.Err()
+}
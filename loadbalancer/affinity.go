@@ -0,0 +1,98 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+AffinityCookie is a cookie issued by the proxy, which pins a user to the server that handled its first request.
+The cookie contains an identity derived from the server's name (not its position in the healthy server pool),
+so HTTP requests and websocket connections sent to servers with the same name land on the same backend, even after the pool changes.
+The name of a server is configured using server{number}_name, and defaults to its address.
+If Secret is set, the cookie is signed using HMAC-SHA256 and cookies with invalid signatures are ignored.
+*/
+type AffinityCookie struct {
+	Name   string
+	Secret []byte
+}
+
+// returns true if affinity cookie has been configured.
+func (ac *AffinityCookie) Enabled() bool {
+	return ac != nil && ac.Name != ""
+}
+
+// ServerIdentity returns the stable identity of the server with the given name.
+func ServerIdentity(name string) string {
+	return strconv.FormatUint(hashString(name), 16)
+}
+
+func (ac *AffinityCookie) sign(identity string) string {
+
+	mac := hmac.New(sha256.New, ac.Secret)
+	mac.Write([]byte(identity))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Encode returns the cookie value for the server with the given name.
+func (ac *AffinityCookie) Encode(name string) string {
+
+	identity := ServerIdentity(name)
+
+	if len(ac.Secret) == 0 {
+		return identity
+	}
+	return identity + "." + ac.sign(identity)
+}
+
+// PinnedServer returns the identity of the server that the request is pinned to, or false if the request has no valid affinity cookie.
+func (ac *AffinityCookie) PinnedServer(r *http.Request) (string, bool) {
+
+	if !ac.Enabled() {
+		return "", false
+	}
+
+	cookie, err := r.Cookie(ac.Name)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+
+	if len(ac.Secret) == 0 {
+		return cookie.Value, true
+	}
+
+	identity, signature, found := strings.Cut(cookie.Value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(ac.sign(identity))) {
+		return "", false
+	}
+	return identity, true
+}
+
+/*
+SetCookie adds a Set-Cookie header pinning the user to the server with the given name, to header.
+The header is not added if the request is already pinned to that server.
+*/
+func (ac *AffinityCookie) SetCookie(header http.Header, r *http.Request, name string) {
+
+	if !ac.Enabled() {
+		return
+	}
+
+	if identity, ok := ac.PinnedServer(r); ok && identity == ServerIdentity(name) {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     ac.Name,
+		Value:    ac.Encode(name),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	header.Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,198 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/util"
+)
+
+// number of points placed on the hash ring for each unit of a server's weight.
+const virtualNodesPerWeight = 100
+
+// RingMember is a server placed on the hash ring.
+type RingMember struct {
+	ServerId int
+	Addr     string
+	Weight   int
+}
+
+type ringPoint struct {
+	hash     uint64
+	serverId int
+}
+
+/*
+HashRing implements ring hash based consistent hashing.
+Each server is placed on the ring at multiple points, which are derived from its address, so that when a server is added or removed,
+only the keys mapped to that server are remapped.
+*/
+type HashRing struct {
+	points     []ringPoint
+	numServers int
+}
+
+func hashString(s string) uint64 {
+
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv hashes of similar strings are close to each other, mixing spreads them across the ring.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func BuildHashRing(members []RingMember) *HashRing {
+
+	hr := &HashRing{points: make([]ringPoint, 0)}
+
+	for _, member := range members {
+
+		if member.Weight <= 0 {
+			continue
+		}
+		hr.numServers++
+
+		for i := 0; i < member.Weight*virtualNodesPerWeight; i++ {
+			hr.points = append(hr.points, ringPoint{hash: hashString(member.Addr + "#" + strconv.Itoa(i)), serverId: member.ServerId})
+		}
+	}
+
+	sort.Slice(hr.points, func(i, j int) bool { return hr.points[i].hash < hr.points[j].hash })
+
+	return hr
+}
+
+/*
+Select returns the id of the server that key is mapped to, or -1 if the ring is empty.
+Servers are visited clockwise from the position of the key on the ring, and the first server for which accept returns true is selected.
+If boundedLoad is greater than 0, a server is skipped if its load exceeds boundedLoad times the average load (consistent hashing with bounded loads).
+A server with weight less than 1 (eg: during slow start) is skipped with probability 1 - weight.
+*/
+func (hr *HashRing) Select(key string, boundedLoad float64, load func(serverId int) int, accept func(serverId int) bool, weight func(serverId int) float64) int {
+
+	if len(hr.points) == 0 {
+		return -1
+	}
+
+	capacity := math.MaxInt
+	if boundedLoad > 0 {
+		seen := make(map[int]bool, hr.numServers)
+		totalLoad := 0
+		for _, point := range hr.points {
+			if !seen[point.serverId] {
+				seen[point.serverId] = true
+				totalLoad += load(point.serverId)
+			}
+		}
+		capacity = int(math.Ceil(boundedLoad * float64(totalLoad+1) / float64(hr.numServers)))
+	}
+
+	keyHash := hashString(key)
+	start := sort.Search(len(hr.points), func(i int) bool { return hr.points[i].hash >= keyHash })
+
+	visited := make(map[int]bool, hr.numServers)
+	fallback := -1
+
+	for i := 0; i < len(hr.points) && len(visited) < hr.numServers; i++ {
+
+		serverId := hr.points[(start+i)%len(hr.points)].serverId
+
+		if visited[serverId] {
+			continue
+		}
+		visited[serverId] = true
+
+		if !accept(serverId) {
+			continue
+		}
+		if fallback == -1 {
+			fallback = serverId
+		}
+		if !admit(weight(serverId)) {
+			continue
+		}
+		if load(serverId)+1 <= capacity {
+			return serverId
+		}
+	}
+
+	// every accepted server is at capacity or was skipped, the key's own server is used.
+	return fallback
+}
+
+// HashKeySource identifies the part of a request used as the key for consistent hashing.
+type HashKeySource struct {
+	Type string // ip, header, cookie or query
+	Name string
+}
+
+// ParseHashKeySource parses a hash key source of the form ip, header:{name}, cookie:{name} or query:{name}.
+func ParseHashKeySource(source string) (HashKeySource, error) {
+
+	if source == "" || source == "ip" {
+		return HashKeySource{Type: "ip"}, nil
+	}
+
+	sourceType, name, found := strings.Cut(source, ":")
+
+	if !found || name == "" || (sourceType != "header" && sourceType != "cookie" && sourceType != "query") {
+		return HashKeySource{}, fmt.Errorf("hash key should be ip/header:{name}/cookie:{name}/query:{name}")
+	}
+
+	return HashKeySource{Type: sourceType, Name: name}, nil
+}
+
+/*
+Extract returns the hash key of the request.
+If the configured header, cookie or query parameter is missing, the user's IP address is used.
+*/
+func (hks HashKeySource) Extract(r *http.Request) string {
+
+	switch hks.Type {
+
+	case "header":
+		if val := r.Header.Get(hks.Name); val != "" {
+			return val
+		}
+
+	case "cookie":
+		if cookie, err := r.Cookie(hks.Name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+
+	case "query":
+		if val := r.URL.Query().Get(hks.Name); val != "" {
+			return val
+		}
+	}
+
+	return clientIP(r)
+}
+
+/*
+returns the user's IP address, resolved by the reverse proxy using X-Forwarded-For entries added by trusted proxies.
+X-Forwarded-For is not read here, as its leftmost entries can be sent by the user.
+*/
+func clientIP(r *http.Request) string {
+
+	if ip, ok := util.ClientIPFromContext(r.Context()); ok {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
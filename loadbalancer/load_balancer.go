@@ -0,0 +1,174 @@
+package loadbalancer
+
+import (
+	"math/rand/v2"
+	"strings"
+	"sync"
+)
+
+// load balancing algorithms that can be configured using algorithm= in the [http] and [websocket] sections.
+const (
+	RoundRobin       = "round-robin"
+	Random           = "random"
+	LeastConnections = "least-connections"
+	PowerOfTwo       = "p2c"
+	WeightedRR       = "weighted-round-robin"
+	ConsistentHash   = "consistent-hash"
+)
+
+var algorithms = []string{RoundRobin, Random, LeastConnections, PowerOfTwo, WeightedRR, ConsistentHash}
+
+func IsValidAlgorithm(algorithm string) bool {
+
+	for _, algo := range algorithms {
+		if algo == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// returns list of algorithms in the format {algo1/algo2/...}, used in config error messages.
+func AlgorithmsFormat() string {
+	return "{" + strings.Join(algorithms, "/") + "}"
+}
+
+// admit returns true with probability weight, used to send less traffic to servers with a weight less than 1 (eg: during slow start).
+func admit(weight float64) bool {
+
+	return weight >= 1 || rand.Float64() < weight
+}
+
+/*
+SelectRoundRobin returns the index of the server at position counter.
+A server with weight less than 1 is skipped with probability 1 - weight, and the next server is considered instead.
+*/
+func SelectRoundRobin(poolSize int, counter int, weight func(index int) float64) int {
+
+	for i := 0; i < poolSize; i++ {
+		index := (counter + i) % poolSize
+		if admit(weight(index)) {
+			return index
+		}
+	}
+	return counter % poolSize
+}
+
+/*
+SelectRandom returns the index of a server selected at random, with probability proportional to its weight.
+*/
+func SelectRandom(poolSize int, weight func(index int) float64) int {
+
+	totalWeight := 0.0
+	for index := 0; index < poolSize; index++ {
+		totalWeight += weight(index)
+	}
+
+	if totalWeight <= 0 {
+		return rand.IntN(poolSize)
+	}
+
+	target := rand.Float64() * totalWeight
+	for index := 0; index < poolSize; index++ {
+		if target -= weight(index); target < 0 {
+			return index
+		}
+	}
+	return poolSize - 1
+}
+
+/*
+SelectLeastConnections returns the index of the server with the least load.
+Servers are scanned starting from offset, so that ties are broken in a round-robin manner instead of always choosing the first server.
+*/
+func SelectLeastConnections(poolSize int, offset int, load func(index int) float64) int {
+
+	selected := offset % poolSize
+	minLoad := load(selected)
+
+	for i := 1; i < poolSize; i++ {
+
+		index := (offset + i) % poolSize
+
+		if l := load(index); l < minLoad {
+			selected = index
+			minLoad = l
+		}
+	}
+	return selected
+}
+
+/*
+SelectPowerOfTwoChoices picks 2 distinct servers at random, and returns the index of the one with the lesser load.
+*/
+func SelectPowerOfTwoChoices(poolSize int, load func(index int) float64) int {
+
+	if poolSize == 1 {
+		return 0
+	}
+
+	server1Index := rand.IntN(poolSize)
+	server2Index := rand.IntN(poolSize - 1)
+
+	if server2Index >= server1Index {
+		server2Index++
+	}
+
+	if load(server2Index) < load(server1Index) {
+		return server2Index
+	}
+	return server1Index
+}
+
+/*
+SmoothWeightedRoundRobin implements nginx's smooth weighted round robin algorithm.
+Each server receives traffic proportional to its weight, and selections of a server are spread out instead of being sent in bursts.
+Current weights are stored by server id, so that they are kept when the healthy server pool changes.
+*/
+type SmoothWeightedRoundRobin struct {
+	currentWeights map[int]float64
+	mutex          *sync.Mutex
+}
+
+func InitializeSmoothWeightedRoundRobin() *SmoothWeightedRoundRobin {
+
+	return &SmoothWeightedRoundRobin{
+		currentWeights: make(map[int]float64),
+		mutex:          &sync.Mutex{},
+	}
+}
+
+/*
+Select returns the index of the selected server, or -1 if no server has a positive weight.
+On each selection, current weight of every server is increased by its weight, the server with the highest current weight is selected,
+and its current weight is reduced by the total weight.
+*/
+func (swrr *SmoothWeightedRoundRobin) Select(poolSize int, serverId func(index int) int, weight func(index int) float64) int {
+
+	swrr.mutex.Lock()
+	defer swrr.mutex.Unlock()
+
+	totalWeight := 0.0
+	selected := -1
+
+	for index := 0; index < poolSize; index++ {
+
+		w := weight(index)
+		if w <= 0 {
+			continue
+		}
+
+		id := serverId(index)
+		swrr.currentWeights[id] += w
+		totalWeight += w
+
+		if selected == -1 || swrr.currentWeights[id] > swrr.currentWeights[serverId(selected)] {
+			selected = index
+		}
+	}
+
+	if selected != -1 {
+		swrr.currentWeights[serverId(selected)] -= totalWeight
+	}
+	return selected
+}
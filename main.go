@@ -7,7 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
-	"time"
+	"syscall"
 
 	"github.com/Adarsh-Kmt/WebsocketReverseProxy/handler"
 )
@@ -41,8 +41,8 @@ func main() {
 
 func run() error {
 
-	// interruptContext used to notify gracefulShutdown go routine, when user enters Ctrl + C.
-	interruptContext, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	// interruptContext used to notify gracefulShutdown go routine, when user enters Ctrl + C or the container is stopped (SIGTERM).
+	interruptContext, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	rp, err := handler.ConfigureReverseProxy()
@@ -61,7 +61,7 @@ func run() error {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
-	go gracefulShutdown(srv, interruptContext, wg)
+	go gracefulShutdown(srv, rp, interruptContext, wg)
 	wg.Wait()
 	return nil
 
@@ -77,20 +77,31 @@ func startListening(rp *http.Server) error {
 }
 
 // Handles graceful shutdown of server.
-// Server waits for all connections to become idle and then stops, or stops after 10 seconds. whichever comes first.
-func gracefulShutdown(rp *http.Server, interruptContext context.Context, wg *sync.WaitGroup) error {
+// Server stops accepting connections, and waits for all connections to become idle and all websocket sessions to end, or stops after the drain timeout. whichever comes first.
+func gracefulShutdown(srv *http.Server, rp *handler.ReverseProxy, interruptContext context.Context, wg *sync.WaitGroup) error {
 
 	defer wg.Done()
 
 	<-interruptContext.Done()
-	shutdownContext, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownContext, cancel := context.WithTimeout(context.Background(), rp.ShutdownTimeout)
 	defer cancel()
 
-	if err := rp.Shutdown(shutdownContext); err != nil {
+	// websocket sessions are drained by the reverse proxy, as hijacked connections are not tracked by the http server.
+	websocketErr := make(chan error, 1)
+	go func() {
+		websocketErr <- rp.Shutdown(shutdownContext)
+	}()
 
+	err := srv.Shutdown(shutdownContext)
+
+	if err != nil {
 		fmt.Println("error during graceful shutdown of http server: ", err.Error())
-		return err
 	}
 
-	return nil
+	if wsErr := <-websocketErr; wsErr != nil {
+		fmt.Println("error during graceful shutdown of websocket sessions: ", wsErr.Error())
+		return wsErr
+	}
+
+	return err
 }
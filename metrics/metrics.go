@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Labels of a single time series, eg: {"server": "1"}.
+type Labels map[string]string
+
+const (
+	counter = "counter"
+	gauge   = "gauge"
+)
+
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]float64 // formatted labels -> value.
+}
+
+/*
+Registry stores counters and gauges, and exposes them in the prometheus text format.
+Metrics are created the first time they are updated, so components do not need to register them beforehand.
+*/
+type Registry struct {
+	metrics map[string]*metric
+	mutex   *sync.Mutex
+}
+
+func InitializeRegistry() *Registry {
+
+	return &Registry{
+		metrics: make(map[string]*metric),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// default registry, used by the package level functions.
+var defaultRegistry = InitializeRegistry()
+
+func formatLabels(labels Labels) string {
+
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[name])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// must be called with mutex held.
+func (reg *Registry) getMetric(name string, help string, kind string) *metric {
+
+	m, ok := reg.metrics[name]
+	if !ok {
+		m = &metric{name: name, help: help, kind: kind, series: make(map[string]float64)}
+		reg.metrics[name] = m
+	}
+	return m
+}
+
+// AddCounter increments the counter with the given name and labels by delta.
+func (reg *Registry) AddCounter(name string, help string, labels Labels, delta float64) {
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	reg.getMetric(name, help, counter).series[formatLabels(labels)] += delta
+}
+
+// SetGauge sets the value of the gauge with the given name and labels.
+func (reg *Registry) SetGauge(name string, help string, labels Labels, value float64) {
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	reg.getMetric(name, help, gauge).series[formatLabels(labels)] = value
+}
+
+// WriteText writes all metrics in the prometheus text exposition format.
+func (reg *Registry) WriteText(w io.Writer) error {
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	names := make([]string, 0, len(reg.metrics))
+	for name := range reg.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+
+		m := reg.metrics[name]
+
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+
+		series := make([]string, 0, len(m.series))
+		for labels := range m.series {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+
+		for _, labels := range series {
+			if _, err := fmt.Fprintf(w, "%s%s %g\n", m.name, labels, m.series[labels]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(200)
+	reg.WriteText(w)
+}
+
+func AddCounter(name string, help string, labels Labels, delta float64) {
+	defaultRegistry.AddCounter(name, help, labels, delta)
+}
+
+func SetGauge(name string, help string, labels Labels, value float64) {
+	defaultRegistry.SetGauge(name, help, labels, value)
+}
+
+// Handler returns a http.Handler that exposes the metrics of the default registry.
+func Handler() http.Handler {
+	return defaultRegistry
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/metrics"
+	"github.com/gookit/ini/v2"
+)
+
+// states of a circuit breaker.
+const (
+	// requests are sent to the server, failures and slow calls are counted.
+	CircuitClosed = "closed"
+	// requests are not sent to the server, until the open duration has passed.
+	CircuitOpen = "open"
+	// a limited number of trial requests are sent to the server, to decide wether the circuit should be closed or opened again.
+	CircuitHalfOpen = "half-open"
+)
+
+// value of the circuit breaker state gauge, for each state.
+var circuitStateValues = map[string]float64{CircuitClosed: 0, CircuitOpen: 1, CircuitHalfOpen: 2}
+
+// keys used to configure circuit breakers at section level.
+var circuitBreakerKeys = []string{
+	"circuit_breaker",
+	"circuit_breaker_error_rate",
+	"circuit_breaker_slow_call_ms",
+	"circuit_breaker_slow_call_rate",
+	"circuit_breaker_window",
+	"circuit_breaker_min_requests",
+	"circuit_breaker_open_duration",
+	"circuit_breaker_half_open_requests",
+}
+
+type CircuitBreakerConfig struct {
+	Enabled bool
+
+	ErrorRate        int           // percentage of failed requests in a window, after which the circuit is opened.
+	SlowCallDuration time.Duration // requests taking longer than SlowCallDuration are slow calls. 0 disables slow call detection.
+	SlowCallRate     int           // percentage of slow calls in a window, after which the circuit is opened.
+	Window           time.Duration // duration over which error rate and slow call rate are calculated.
+	MinRequests      int           // minimum number of requests in a window, before error rate and slow call rate are considered.
+
+	OpenDuration     time.Duration // duration for which the circuit stays open, before trial requests are allowed.
+	HalfOpenRequests int           // number of successful trial requests required to close the circuit.
+}
+
+func ConfigureCircuitBreaker(section ini.Section, sectionName string) (CircuitBreakerConfig, error) {
+
+	var cfg CircuitBreakerConfig
+	var err error
+
+	if cfg.Enabled, err = parseSectionBoolConfig(section, "circuit_breaker", sectionName, false); err != nil {
+		return cfg, err
+	}
+	if cfg.ErrorRate, err = parseSectionIntConfig(section, "circuit_breaker_error_rate", sectionName, 50); err != nil {
+		return cfg, err
+	}
+	if cfg.SlowCallRate, err = parseSectionIntConfig(section, "circuit_breaker_slow_call_rate", sectionName, 50); err != nil {
+		return cfg, err
+	}
+	if cfg.MinRequests, err = parseSectionIntConfig(section, "circuit_breaker_min_requests", sectionName, 20); err != nil {
+		return cfg, err
+	}
+	if cfg.HalfOpenRequests, err = parseSectionIntConfig(section, "circuit_breaker_half_open_requests", sectionName, 3); err != nil {
+		return cfg, err
+	}
+
+	// durations are configured in milliseconds.
+	slowCallMs, err := parseSectionIntConfig(section, "circuit_breaker_slow_call_ms", sectionName, 0)
+	if err != nil {
+		return cfg, err
+	}
+	window, err := parseSectionIntConfig(section, "circuit_breaker_window", sectionName, 10000)
+	if err != nil {
+		return cfg, err
+	}
+	openDuration, err := parseSectionIntConfig(section, "circuit_breaker_open_duration", sectionName, 30000)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.ErrorRate > 100 || cfg.SlowCallRate > 100 {
+		return cfg, fmt.Errorf("invalid config, %s.circuit_breaker_error_rate and %s.circuit_breaker_slow_call_rate should be percentages between 0 and 100", sectionName, sectionName)
+	}
+	if window == 0 || openDuration == 0 || cfg.HalfOpenRequests == 0 {
+		return cfg, fmt.Errorf("invalid config, %s.circuit_breaker_window, %s.circuit_breaker_open_duration and %s.circuit_breaker_half_open_requests should be positive", sectionName, sectionName, sectionName)
+	}
+
+	cfg.SlowCallDuration = time.Duration(slowCallMs) * time.Millisecond
+	cfg.Window = time.Duration(window) * time.Millisecond
+	cfg.OpenDuration = time.Duration(openDuration) * time.Millisecond
+
+	return cfg, nil
+}
+
+/*
+CircuitBreaker stops requests from being sent to a degraded server, so that they can be sent to other servers instead of waiting in the server's job channel.
+The circuit is opened when the error rate or slow call rate of the server over a window is too high.
+After the open duration, the circuit becomes half open, and a limited number of trial requests are sent to the server.
+The circuit is closed if every trial request succeeds, and opened again if any of them fails.
+*/
+type CircuitBreaker struct {
+	config   CircuitBreakerConfig
+	serverId int
+
+	state      string
+	generation int // incremented on every transition, so that results of requests admitted in an earlier state can be ignored.
+	openedAt   time.Time
+
+	windowStart     time.Time
+	windowRequests  int
+	windowFailures  int
+	windowSlowCalls int
+
+	halfOpenInFlight  int // number of trial requests sent to the server, whose result has not been recorded yet.
+	halfOpenSuccesses int
+
+	mutex  *sync.Mutex
+	logger *log.Logger
+}
+
+func InitializeCircuitBreaker(cfg CircuitBreakerConfig, serverId int, logger *log.Logger) *CircuitBreaker {
+
+	cb := &CircuitBreaker{
+		config:      cfg,
+		serverId:    serverId,
+		state:       CircuitClosed,
+		windowStart: time.Now(),
+		mutex:       &sync.Mutex{},
+		logger:      logger,
+	}
+
+	if cfg.Enabled {
+		cb.recordStateMetric()
+	}
+	return cb
+}
+
+func (cb *CircuitBreaker) recordStateMetric() {
+
+	metrics.SetGauge("proxy_circuit_breaker_state", "state of the circuit breaker of a http server (0 = closed, 1 = open, 2 = half-open).", metrics.Labels{"server": strconv.Itoa(cb.serverId)}, circuitStateValues[cb.state])
+}
+
+func (cb *CircuitBreaker) recordRejection() {
+
+	metrics.AddCounter("proxy_circuit_breaker_rejected_total", "number of requests not sent to a http server because its circuit breaker was open.", metrics.Labels{"server": strconv.Itoa(cb.serverId)}, 1)
+}
+
+// must be called with mutex held.
+func (cb *CircuitBreaker) transition(to string, now time.Time, reason string) {
+
+	cb.logger.Printf("circuit breaker changed from %s to %s : %s", cb.state, to, reason)
+
+	cb.state = to
+	cb.generation++
+	cb.halfOpenInFlight = 0
+	cb.halfOpenSuccesses = 0
+
+	switch to {
+	case CircuitOpen:
+		cb.openedAt = now
+	case CircuitClosed:
+		cb.windowStart = now
+		cb.windowRequests = 0
+		cb.windowFailures = 0
+		cb.windowSlowCalls = 0
+	}
+
+	cb.recordStateMetric()
+	metrics.AddCounter("proxy_circuit_breaker_transitions_total", "number of times the circuit breaker of a http server changed state.", metrics.Labels{"server": strconv.Itoa(cb.serverId), "state": to}, 1)
+}
+
+// must be called with mutex held. moves an open circuit to half open once the open duration has passed.
+func (cb *CircuitBreaker) refresh(now time.Time) {
+
+	if cb.state == CircuitOpen && now.Sub(cb.openedAt) >= cb.config.OpenDuration {
+		cb.transition(CircuitHalfOpen, now, fmt.Sprintf("open for %s, allowing %d trial requests", cb.config.OpenDuration, cb.config.HalfOpenRequests))
+	}
+}
+
+// State returns the current state of the circuit.
+func (cb *CircuitBreaker) State() string {
+
+	if cb == nil || !cb.config.Enabled {
+		return CircuitClosed
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.refresh(time.Now())
+	return cb.state
+}
+
+// Ready returns true if a request could currently be sent to the server, without reserving a trial request.
+func (cb *CircuitBreaker) Ready() bool {
+
+	if cb == nil || !cb.config.Enabled {
+		return true
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.refresh(time.Now())
+
+	switch cb.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return cb.halfOpenInFlight < cb.config.HalfOpenRequests-cb.halfOpenSuccesses
+	}
+	return true
+}
+
+// CircuitPermit is returned by Acquire, and identifies the state of the circuit in which a request was admitted.
+type CircuitPermit struct {
+	generation int
+}
+
+/*
+Acquire returns true if a request can be sent to the server. In half open state, it reserves one of the trial requests.
+Every successful Acquire must be followed by a call to RecordResult with the returned permit.
+*/
+func (cb *CircuitBreaker) Acquire() (CircuitPermit, bool) {
+
+	if cb == nil || !cb.config.Enabled {
+		return CircuitPermit{}, true
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.refresh(time.Now())
+
+	switch cb.state {
+	case CircuitOpen:
+		cb.recordRejection()
+		return CircuitPermit{}, false
+
+	case CircuitHalfOpen:
+		if cb.halfOpenInFlight >= cb.config.HalfOpenRequests-cb.halfOpenSuccesses {
+			cb.recordRejection()
+			return CircuitPermit{}, false
+		}
+		cb.halfOpenInFlight++
+	}
+	return CircuitPermit{generation: cb.generation}, true
+}
+
+/*
+RecordResult records the outcome and latency of a request sent to the server, and opens/closes the circuit if required.
+Results of requests admitted before the last transition are ignored, so that requests admitted while the circuit was closed
+are not counted as trial requests once it becomes half open.
+*/
+func (cb *CircuitBreaker) RecordResult(permit CircuitPermit, outcome Outcome, latency time.Duration) {
+
+	if cb == nil || !cb.config.Enabled {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if permit.generation != cb.generation {
+		return
+	}
+
+	now := time.Now()
+	failed := outcome == ServerError || outcome == ConnectionFailure
+	slow := cb.config.SlowCallDuration > 0 && latency > cb.config.SlowCallDuration
+
+	switch cb.state {
+
+	case CircuitHalfOpen:
+		if cb.halfOpenInFlight > 0 {
+			cb.halfOpenInFlight--
+		}
+		if outcome == Ignored {
+			return
+		}
+		if failed || slow {
+			cb.transition(CircuitOpen, now, fmt.Sprintf("trial request failed (latency %s)", latency))
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.config.HalfOpenRequests {
+			cb.transition(CircuitClosed, now, fmt.Sprintf("%d trial requests succeeded", cb.halfOpenSuccesses))
+		}
+
+	case CircuitClosed:
+		if outcome == Ignored {
+			return
+		}
+
+		if now.Sub(cb.windowStart) > cb.config.Window {
+			cb.windowStart = now
+			cb.windowRequests = 0
+			cb.windowFailures = 0
+			cb.windowSlowCalls = 0
+		}
+
+		cb.windowRequests++
+		if failed {
+			cb.windowFailures++
+		}
+		if slow {
+			cb.windowSlowCalls++
+		}
+
+		if cb.windowRequests < cb.config.MinRequests {
+			return
+		}
+
+		if cb.config.ErrorRate > 0 && cb.windowFailures*100 >= cb.config.ErrorRate*cb.windowRequests {
+			cb.transition(CircuitOpen, now, fmt.Sprintf("%d of %d requests failed in the last %s", cb.windowFailures, cb.windowRequests, cb.config.Window))
+		} else if cb.config.SlowCallDuration > 0 && cb.config.SlowCallRate > 0 && cb.windowSlowCalls*100 >= cb.config.SlowCallRate*cb.windowRequests {
+			cb.transition(CircuitOpen, now, fmt.Sprintf("%d of %d requests took longer than %s in the last %s", cb.windowSlowCalls, cb.windowRequests, cb.config.SlowCallDuration, cb.config.Window))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerIgnoresStaleResultsInHalfOpen(t *testing.T) {
+
+	cfg := CircuitBreakerConfig{
+		Enabled:          true,
+		ErrorRate:        50,
+		Window:           time.Minute,
+		MinRequests:      1,
+		OpenDuration:     10 * time.Millisecond,
+		HalfOpenRequests: 1,
+	}
+	cb := InitializeCircuitBreaker(cfg, 1, log.New(io.Discard, "", 0))
+
+	// admitted while the circuit is closed, completes after it becomes half open.
+	stale, ok := cb.Acquire()
+	if !ok {
+		t.Fatal("request rejected while circuit is closed")
+	}
+
+	failed, _ := cb.Acquire()
+	cb.RecordResult(failed, ServerError, time.Millisecond)
+
+	if state := cb.State(); state != CircuitOpen {
+		t.Fatalf("state = %s after failure, want %s", state, CircuitOpen)
+	}
+
+	time.Sleep(2 * cfg.OpenDuration)
+
+	if state := cb.State(); state != CircuitHalfOpen {
+		t.Fatalf("state = %s after open duration, want %s", state, CircuitHalfOpen)
+	}
+
+	cb.RecordResult(stale, Success, time.Millisecond)
+
+	if state := cb.State(); state != CircuitHalfOpen {
+		t.Fatalf("state = %s after stale success, want %s", state, CircuitHalfOpen)
+	}
+
+	// the stale result must not free the only trial request.
+	trial, ok := cb.Acquire()
+	if !ok {
+		t.Fatal("trial request rejected")
+	}
+	if _, ok := cb.Acquire(); ok {
+		t.Fatal("second trial request admitted, want only 1")
+	}
+
+	cb.RecordResult(stale, ServerError, time.Millisecond)
+
+	if state := cb.State(); state != CircuitHalfOpen {
+		t.Fatalf("state = %s after stale failure, want %s", state, CircuitHalfOpen)
+	}
+
+	cb.RecordResult(trial, Success, time.Millisecond)
+
+	if state := cb.State(); state != CircuitClosed {
+		t.Fatalf("state = %s after trial success, want %s", state, CircuitClosed)
+	}
+}
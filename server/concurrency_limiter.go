@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/metrics"
+	"github.com/gookit/ini/v2"
+)
+
+// keys used to configure concurrency limiters at section level.
+var concurrencyLimitKeys = []string{"concurrency_limit", "concurrency_limit_latency_tolerance", "concurrency_limit_backoff"}
+
+// duration after which the minimum latency of a server is measured again, so that the limiter adapts when the server becomes permanently slower.
+const minLatencyWindow = 30 * time.Second
+
+type ConcurrencyLimitConfig struct {
+	Adaptive         bool    // if false, the limit stays at the maximum number of workers of the server.
+	LatencyTolerance float64 // requests taking longer than LatencyTolerance times the minimum latency of the server decrease the limit.
+	BackoffPercent   int     // percentage of its current value that the limit is decreased to, when the server is overloaded.
+}
+
+func ConfigureConcurrencyLimit(section ini.Section, sectionName string) (ConcurrencyLimitConfig, error) {
+
+	cfg := ConcurrencyLimitConfig{Adaptive: true, LatencyTolerance: 2}
+	var err error
+
+	switch limit := strings.ToLower(section["concurrency_limit"]); limit {
+	case "", "adaptive":
+		cfg.Adaptive = true
+	case "fixed":
+		cfg.Adaptive = false
+	default:
+		return cfg, fmt.Errorf("invalid config, %s.concurrency_limit should be adaptive/fixed", sectionName)
+	}
+
+	if val := section["concurrency_limit_latency_tolerance"]; val != "" {
+		cfg.LatencyTolerance, err = strconv.ParseFloat(val, 64)
+		if err != nil || cfg.LatencyTolerance < 1 {
+			return cfg, fmt.Errorf("invalid config, %s.concurrency_limit_latency_tolerance should be a number greater than or equal to 1", sectionName)
+		}
+	}
+
+	if cfg.BackoffPercent, err = parseSectionIntConfig(section, "concurrency_limit_backoff", sectionName, 90); err != nil {
+		return cfg, err
+	}
+	if cfg.BackoffPercent == 0 || cfg.BackoffPercent >= 100 {
+		return cfg, fmt.Errorf("invalid config, %s.concurrency_limit_backoff should be a percentage between 1 and 99", sectionName)
+	}
+
+	return cfg, nil
+}
+
+/*
+ConcurrencyLimiter limits the number of requests sent to a server at the same time, between the minimum and maximum number of workers of the server.
+The limit is adjusted using AIMD (additive increase, multiplicative decrease), based on the latency of completed requests:
+the limit is increased by 1 for every limit successful requests, and decreased by BackoffPercent when a request fails,
+or takes longer than LatencyTolerance times the minimum latency observed recently.
+Requests above the limit are rejected immediately, or wait in the queue of the server if queuing is enabled.
+*/
+type ConcurrencyLimiter struct {
+	config   ConcurrencyLimitConfig
+	serverId int
+
+	limit    float64
+	minLimit float64
+	maxLimit float64
+	inFlight int
+
+	queue   *PriorityQueue // requests waiting to be admitted, once a request completes or the limit is increased.
+	maxWait time.Duration
+
+	minLatency     time.Duration // minimum latency observed in the current and previous window.
+	prevMinLatency time.Duration
+	windowStart    time.Time
+	lastDecrease   time.Time
+
+	mutex  *sync.Mutex
+	logger *log.Logger
+}
+
+func InitializeConcurrencyLimiter(cfg ConcurrencyLimitConfig, serverId int, minLimit int, maxLimit int, queue *PriorityQueue, maxWait time.Duration, logger *log.Logger) *ConcurrencyLimiter {
+
+	cl := &ConcurrencyLimiter{
+		config:      cfg,
+		serverId:    serverId,
+		limit:       float64(maxLimit),
+		minLimit:    float64(max(minLimit, 1)),
+		maxLimit:    float64(maxLimit),
+		queue:       queue,
+		maxWait:     maxWait,
+		windowStart: time.Now(),
+		mutex:       &sync.Mutex{},
+		logger:      logger,
+	}
+
+	cl.recordLimitMetric()
+	return cl
+}
+
+func (cl *ConcurrencyLimiter) recordLimitMetric() {
+
+	metrics.SetGauge("proxy_http_concurrency_limit", "maximum number of requests sent to a http server at the same time.", metrics.Labels{"server": strconv.Itoa(cl.serverId)}, math.Floor(cl.limit))
+}
+
+/*
+Acquire returns true if one more request can be sent to the server, and counts it as in flight. Every successful Acquire must be followed by a call to Release.
+Requests are not admitted while other requests are waiting in the queue, so that they do not overtake queued requests.
+*/
+func (cl *ConcurrencyLimiter) Acquire() bool {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if cl.inFlight >= int(cl.limit) || cl.queue.Len() > 0 {
+		metrics.AddCounter("proxy_http_concurrency_rejected_total", "number of requests not sent to a http server because its concurrency limit was reached.", metrics.Labels{"server": strconv.Itoa(cl.serverId)}, 1)
+		return false
+	}
+	cl.inFlight++
+	return true
+}
+
+// QueueEnabled returns true if requests above the limit can wait in the queue of the server.
+func (cl *ConcurrencyLimiter) QueueEnabled() bool {
+
+	return cl.maxWait > 0
+}
+
+/*
+Wait queues the request until it is admitted, and counts it as in flight. Every successful Wait must be followed by a call to Release.
+Returns ErrQueueFull if the request could not be queued or was rejected from the queue to make room for another user, ErrQueueTimeout if it was not admitted within the maximum queue wait time,
+or the error of ctx if it is done before the request is admitted.
+*/
+func (cl *ConcurrencyLimiter) Wait(ctx context.Context, entry *QueueEntry) error {
+
+	cl.mutex.Lock()
+
+	if cl.inFlight < int(cl.limit) && cl.queue.Len() == 0 {
+		cl.inFlight++
+		cl.mutex.Unlock()
+		return nil
+	}
+
+	if err := cl.queue.Push(entry); err != nil {
+		cl.mutex.Unlock()
+		return err
+	}
+	cl.mutex.Unlock()
+
+	timer := time.NewTimer(cl.maxWait)
+	defer timer.Stop()
+
+	var err error
+
+	select {
+	case <-entry.admitted:
+		return nil
+	case <-entry.evicted:
+		return ErrQueueFull
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	// the request was admitted while the timeout or cancellation was being handled.
+	if entry.isAdmitted {
+		return nil
+	}
+	// the request was rejected from the queue while the timeout or cancellation was being handled.
+	if entry.isEvicted {
+		return ErrQueueFull
+	}
+
+	reason := "timeout"
+	if err != ErrQueueTimeout {
+		reason = "cancelled"
+	}
+	cl.queue.Remove(entry, reason)
+	return err
+}
+
+// must be called with mutex held. admits queued requests while the number of requests in flight is below the limit.
+func (cl *ConcurrencyLimiter) admitQueued() {
+
+	for cl.inFlight < int(cl.limit) {
+
+		entry := cl.queue.Pop()
+		if entry == nil {
+			return
+		}
+		cl.inFlight++
+		entry.isAdmitted = true
+		close(entry.admitted)
+	}
+}
+
+// Release records that a request acquired using Acquire or Wait is no longer in flight, and admits the next queued request.
+func (cl *ConcurrencyLimiter) Release() {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if cl.inFlight > 0 {
+		cl.inFlight--
+	}
+	cl.admitQueued()
+}
+
+// InFlight returns the number of requests currently sent to the server.
+func (cl *ConcurrencyLimiter) InFlight() int {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.inFlight
+}
+
+// RecordResult adjusts the limit based on the outcome and latency of a request sent to the server.
+func (cl *ConcurrencyLimiter) RecordResult(outcome Outcome, latency time.Duration) {
+
+	if !cl.config.Adaptive || outcome == Ignored {
+		return
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(cl.windowStart) > minLatencyWindow {
+		cl.windowStart = now
+		cl.prevMinLatency = cl.minLatency
+		cl.minLatency = 0
+	}
+
+	failed := outcome == ServerError || outcome == ConnectionFailure
+
+	if !failed && (cl.minLatency == 0 || latency < cl.minLatency) {
+		cl.minLatency = latency
+	}
+
+	baseline := cl.minLatency
+	if cl.prevMinLatency > 0 && cl.prevMinLatency < baseline {
+		baseline = cl.prevMinLatency
+	}
+
+	congested := failed || float64(latency) > cl.config.LatencyTolerance*float64(baseline)
+
+	previous := math.Floor(cl.limit)
+
+	if congested {
+		// requests sent before the last decrease complete with the same latency, so the limit is decreased at most once per request latency.
+		if now.Sub(cl.lastDecrease) < latency {
+			return
+		}
+		cl.lastDecrease = now
+		cl.limit = math.Max(cl.minLimit, cl.limit*float64(cl.config.BackoffPercent)/100)
+
+	} else if cl.inFlight*2 >= int(cl.limit) {
+		// the limit is only increased while it is being used, so that it does not grow without bound when traffic is low.
+		cl.limit = math.Min(cl.maxLimit, cl.limit+1/cl.limit)
+	}
+
+	if current := math.Floor(cl.limit); current != previous {
+		cl.logger.Printf("concurrency limit changed from %d to %d (latency %s, minimum latency %s)", int(previous), int(current), latency, baseline)
+		cl.recordLimitMetric()
+		cl.admitQueued()
+	}
+}
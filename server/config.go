@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gookit/ini/v2"
+)
+
+/*
+groupNumberedKeys groups keys of the form {prefix}{number}_{config_name} (eg: server1_addr) by number.
+Keys of the form {prefix}{number} are stored with an empty config name.
+Keys present in sectionKeys are section level configs, and keys of the form {otherPrefix}{number}_{config_name} are grouped separately, so both are skipped.
+Returns the configs of each number, along with the sorted list of numbers.
+*/
+func groupNumberedKeys(section ini.Section, sectionName string, prefix string, sectionKeys []string, otherPrefixes ...string) (map[int]map[string]string, []int, error) {
+
+	configs := make(map[int]map[string]string)
+
+	for key, val := range section {
+
+		if containsKey(key, sectionKeys) || hasNumberedPrefix(key, otherPrefixes...) {
+			continue
+		}
+
+		if !strings.HasPrefix(key, prefix) {
+			return nil, nil, fmt.Errorf("invalid config, unknown key %s.%s", sectionName, key)
+		}
+
+		number, configName, _ := strings.Cut(strings.TrimPrefix(key, prefix), "_")
+
+		id, err := strconv.Atoi(number)
+		if err != nil || id < 1 {
+			return nil, nil, fmt.Errorf("invalid config, %s.%s should be of the form %s{number}_{config_name}", sectionName, key, prefix)
+		}
+
+		if _, ok := configs[id]; !ok {
+			configs[id] = make(map[string]string)
+		}
+		configs[id][configName] = val
+	}
+
+	ids := make([]int, 0, len(configs))
+	for id := range configs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	// ids are used as indexes, eg: server ids are used as indexes into the server pool by health checks.
+	for index, id := range ids {
+		if id != index+1 {
+			return nil, nil, fmt.Errorf("invalid config, %s %ss should be numbered consecutively starting from %s1, %s%d is missing", sectionName, prefix, prefix, prefix, index+1)
+		}
+	}
+
+	return configs, ids, nil
+}
+
+// returns true if key is of the form {prefix}{number}... for any of the prefixes.
+func hasNumberedPrefix(key string, prefixes ...string) bool {
+
+	for _, prefix := range prefixes {
+		if rest, ok := strings.CutPrefix(key, prefix); ok && rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+			return true
+		}
+	}
+	return false
+}
+
+func concatKeys(keyLists ...[]string) []string {
+
+	keys := make([]string, 0)
+	for _, keyList := range keyLists {
+		keys = append(keys, keyList...)
+	}
+	return keys
+}
+
+func containsKey(key string, keys []string) bool {
+
+	for _, k := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the name of a server, used to pin users to the same backend in both sections. Defaults to the address of the server.
+func serverName(config map[string]string, addr string) string {
+
+	if name := strings.TrimSpace(config["name"]); name != "" {
+		return name
+	}
+	return addr
+}
+
+// parses config value of a server as a non negative integer, returns defaultValue if the config is not present.
+func parseServerIntConfig(config map[string]string, configName string, serverId int, defaultValue int) (int, error) {
+
+	return parseNumberedIntConfig(config, "server", configName, serverId, defaultValue)
+}
+
+// parses config value of {prefix}{id}_{configName} as a non negative integer, returns defaultValue if the config is not present.
+func parseNumberedIntConfig(config map[string]string, prefix string, configName string, id int, defaultValue int) (int, error) {
+
+	val, ok := config[configName]
+
+	if !ok || val == "" {
+		return defaultValue, nil
+	}
+
+	intVal, err := strconv.Atoi(val)
+
+	if err != nil || intVal < 0 {
+		return 0, fmt.Errorf("invalid config, %s%d_%s value must be a valid non negative integer", prefix, id, configName)
+	}
+	return intVal, nil
+}
+
+// parses section level config value as a non negative integer, returns defaultValue if the config is not present.
+func parseSectionIntConfig(section ini.Section, key string, sectionName string, defaultValue int) (int, error) {
+
+	val, ok := section[key]
+
+	if !ok || val == "" {
+		return defaultValue, nil
+	}
+
+	intVal, err := strconv.Atoi(val)
+
+	if err != nil || intVal < 0 {
+		return 0, fmt.Errorf("invalid config, %s.%s should be a valid non negative integer", sectionName, key)
+	}
+	return intVal, nil
+}
+
+// parses section level config value as true/false, returns defaultValue if the config is not present.
+func parseSectionBoolConfig(section ini.Section, key string, sectionName string, defaultValue bool) (bool, error) {
+
+	switch strings.ToLower(section[key]) {
+	case "":
+		return defaultValue, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid config, %s.%s should be true/false", sectionName, key)
+	}
+}
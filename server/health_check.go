@@ -0,0 +1,361 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximum number of bytes of a health check response body that are read.
+const maxHealthCheckBodySize = 64 * 1024
+
+// keys used to configure health checks, at section level ({section}.health_check_path) or per server (server{number}_health_check_path).
+var healthCheckKeys = []string{
+	"health_check_type",
+	"health_check_path",
+	"health_check_method",
+	"health_check_headers",
+	"health_check_expected_status",
+	"health_check_timeout",
+	"health_check_body_contains",
+	"health_check_body_regex",
+	"health_check_json_path",
+	"health_check_json_value",
+	"health_check_drain_status",
+	"health_check_rise",
+	"health_check_fall",
+}
+
+// types of health checks.
+const (
+	// response body must be a JSON object, with value at JSONPath equal to JSONValue. eg: {"status":200}
+	JSONHealthCheck = "json"
+	// only status code (and body matchers, if configured) of the response are checked.
+	HTTPHealthCheck = "http"
+)
+
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// HealthCheckConfig describes the request sent to a server during a health check, and the response expected from a healthy server.
+type HealthCheckConfig struct {
+	Type    string
+	Path    string
+	Method  string
+	Headers http.Header
+	Timeout time.Duration
+
+	ExpectedStatus []StatusRange // if empty, any status code is accepted.
+
+	BodyContains string
+	BodyRegex    *regexp.Regexp
+
+	JSONPath  string // dot separated path of a value in the JSON body. eg: data.status
+	JSONValue string
+
+	DrainStatus []StatusRange // status codes used by a server to ask the proxy to stop sending new traffic to it.
+
+	Rise int // number of consecutive successful health checks required for an unhealthy server to become healthy.
+	Fall int // number of consecutive failed health checks required for a healthy server to become unhealthy.
+}
+
+/*
+DefaultHealthCheckConfig returns the health check used when no health check keys are configured:
+GET /healthCheck, expecting a JSON body of the form {"status":200}.
+*/
+func DefaultHealthCheckConfig() HealthCheckConfig {
+
+	return HealthCheckConfig{
+		Type:      JSONHealthCheck,
+		Path:      "/healthCheck",
+		Method:    http.MethodGet,
+		Headers:   http.Header{},
+		Timeout:   2 * time.Second,
+		JSONPath:  "status",
+		JSONValue: "200",
+		Rise:      2,
+		Fall:      3,
+	}
+}
+
+/*
+ConfigureHealthCheck overrides the health check configs in base with the values present in config.
+keys in config are of the form health_check_{config_name}, keyPrefix is only used in error messages (eg: "http." or "server1_").
+*/
+func ConfigureHealthCheck(config map[string]string, base HealthCheckConfig, keyPrefix string) (HealthCheckConfig, error) {
+
+	hc := base
+	hc.Headers = base.Headers.Clone()
+
+	if val, ok := config["health_check_type"]; ok && val != "" {
+
+		switch val = strings.ToLower(val); val {
+		case JSONHealthCheck:
+		case HTTPHealthCheck:
+			// a plain HTTP health check accepts any 2xx response, unless configured otherwise.
+			if len(base.ExpectedStatus) == 0 {
+				hc.ExpectedStatus = []StatusRange{{Min: 200, Max: 299}}
+			}
+		default:
+			return hc, fmt.Errorf("invalid config, %shealth_check_type should be json/http", keyPrefix)
+		}
+		hc.Type = val
+	}
+
+	if val, ok := config["health_check_path"]; ok && val != "" {
+		if !strings.HasPrefix(val, "/") {
+			return hc, fmt.Errorf("invalid config, %shealth_check_path should start with /", keyPrefix)
+		}
+		hc.Path = val
+	}
+
+	if val, ok := config["health_check_method"]; ok && val != "" {
+		hc.Method = strings.ToUpper(val)
+	}
+
+	if val, ok := config["health_check_headers"]; ok && val != "" {
+		for _, header := range strings.Split(val, ",") {
+			name, value, found := strings.Cut(header, ":")
+			if !found || strings.TrimSpace(name) == "" {
+				return hc, fmt.Errorf("invalid config, %shealth_check_headers should be of the form {name}:{value},{name}:{value}", keyPrefix)
+			}
+			hc.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
+	if val, ok := config["health_check_expected_status"]; ok && val != "" {
+		ranges, err := parseStatusRanges(val)
+		if err != nil {
+			return hc, fmt.Errorf("invalid config, %shealth_check_expected_status should be a comma separated list of status codes/ranges (eg: 200,204,300-399,5xx)", keyPrefix)
+		}
+		hc.ExpectedStatus = ranges
+	}
+
+	if val, ok := config["health_check_timeout"]; ok && val != "" {
+		timeout, err := strconv.Atoi(val)
+		if err != nil || timeout <= 0 {
+			return hc, fmt.Errorf("invalid config, %shealth_check_timeout should be a valid positive integer", keyPrefix)
+		}
+		hc.Timeout = time.Duration(timeout) * time.Millisecond
+	}
+
+	if val, ok := config["health_check_body_contains"]; ok {
+		hc.BodyContains = val
+	}
+
+	if val, ok := config["health_check_body_regex"]; ok && val != "" {
+		regex, err := regexp.Compile(val)
+		if err != nil {
+			return hc, fmt.Errorf("invalid config, %shealth_check_body_regex should be a valid regular expression : %s", keyPrefix, err.Error())
+		}
+		hc.BodyRegex = regex
+	}
+
+	if val, ok := config["health_check_json_path"]; ok && val != "" {
+		hc.JSONPath = val
+	}
+
+	if val, ok := config["health_check_json_value"]; ok && val != "" {
+		hc.JSONValue = val
+	}
+
+	if val, ok := config["health_check_drain_status"]; ok && val != "" {
+		ranges, err := parseStatusRanges(val)
+		if err != nil {
+			return hc, fmt.Errorf("invalid config, %shealth_check_drain_status should be a comma separated list of status codes/ranges (eg: 410,503)", keyPrefix)
+		}
+		hc.DrainStatus = ranges
+	}
+
+	if val, ok := config["health_check_rise"]; ok && val != "" {
+		rise, err := strconv.Atoi(val)
+		if err != nil || rise <= 0 {
+			return hc, fmt.Errorf("invalid config, %shealth_check_rise should be a valid positive integer", keyPrefix)
+		}
+		hc.Rise = rise
+	}
+
+	if val, ok := config["health_check_fall"]; ok && val != "" {
+		fall, err := strconv.Atoi(val)
+		if err != nil || fall <= 0 {
+			return hc, fmt.Errorf("invalid config, %shealth_check_fall should be a valid positive integer", keyPrefix)
+		}
+		hc.Fall = fall
+	}
+
+	return hc, nil
+}
+
+// parses status ranges of the form 200,204,300-399,5xx
+func parseStatusRanges(val string) ([]StatusRange, error) {
+
+	ranges := make([]StatusRange, 0)
+
+	for _, entry := range strings.Split(val, ",") {
+
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if len(entry) == 3 && strings.HasSuffix(entry, "xx") {
+			class, err := strconv.Atoi(entry[:1])
+			if err != nil || class < 1 || class > 5 {
+				return nil, fmt.Errorf("invalid status class %s", entry)
+			}
+			ranges = append(ranges, StatusRange{Min: class * 100, Max: class*100 + 99})
+			continue
+		}
+
+		minString, maxString, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			maxString = minString
+		}
+
+		min, err := strconv.Atoi(strings.TrimSpace(minString))
+		if err != nil {
+			return nil, err
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(maxString))
+		if err != nil || max < min {
+			return nil, fmt.Errorf("invalid status range %s", entry)
+		}
+		ranges = append(ranges, StatusRange{Min: min, Max: max})
+	}
+
+	return ranges, nil
+}
+
+func statusInRanges(status int, ranges []StatusRange) bool {
+
+	for _, statusRange := range ranges {
+		if status >= statusRange.Min && status <= statusRange.Max {
+			return true
+		}
+	}
+	return false
+}
+
+func (hc HealthCheckConfig) statusExpected(status int) bool {
+
+	return len(hc.ExpectedStatus) == 0 || statusInRanges(status, hc.ExpectedStatus)
+}
+
+/*
+Check sends a health check request to the server at addr.
+Returns nil if the server is healthy, ErrDraining if the server responded with a drain status code, otherwise an error describing why the check failed.
+*/
+func (hc HealthCheckConfig) Check(client *http.Client, addr string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, hc.Method, "http://"+addr+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+
+	for key, values := range hc.Headers {
+		req.Header[key] = append(req.Header[key], values...)
+	}
+	// Host header cannot be set using req.Header.
+	if host := hc.Headers.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if statusInRanges(response.StatusCode, hc.DrainStatus) {
+		return ErrDraining
+	}
+
+	if !hc.statusExpected(response.StatusCode) {
+		return fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+
+	// body is only read if a body matcher needs it.
+	if hc.Type != JSONHealthCheck && hc.BodyContains == "" && hc.BodyRegex == nil {
+		return nil
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(response.Body, maxHealthCheckBodySize))
+	if err != nil {
+		return fmt.Errorf("error while reading health check response : %w", err)
+	}
+
+	if hc.BodyContains != "" && !strings.Contains(string(respBody), hc.BodyContains) {
+		return fmt.Errorf("response body does not contain %q", hc.BodyContains)
+	}
+
+	if hc.BodyRegex != nil && !hc.BodyRegex.Match(respBody) {
+		return fmt.Errorf("response body does not match %q", hc.BodyRegex.String())
+	}
+
+	if hc.Type == JSONHealthCheck {
+
+		var body any
+		if err := json.Unmarshal(respBody, &body); err != nil {
+			return fmt.Errorf("error while json decoding health check response : %w", err)
+		}
+
+		value, found := lookupJSONPath(body, hc.JSONPath)
+		if !found {
+			return fmt.Errorf("health check response does not contain %s", hc.JSONPath)
+		}
+		if value != hc.JSONValue {
+			return fmt.Errorf("value of %s in health check response is %s, expected %s", hc.JSONPath, value, hc.JSONValue)
+		}
+	}
+
+	return nil
+}
+
+// returns the value at a dot separated path (eg: data.checks.0.status) of a decoded JSON body, formatted as a string.
+func lookupJSONPath(body any, path string) (string, bool) {
+
+	current := body
+
+	for _, segment := range strings.Split(path, ".") {
+
+		switch node := current.(type) {
+
+		case map[string]any:
+			value, ok := node[segment]
+			if !ok {
+				return "", false
+			}
+			current = value
+
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			current = node[index]
+
+		default:
+			return "", false
+		}
+	}
+
+	switch value := current.(type) {
+	case string:
+		return value, true
+	case nil:
+		return "null", true
+	case map[string]any, []any:
+		encoded, _ := json.Marshal(value)
+		return string(encoded), true
+	default:
+		return fmt.Sprint(value), true
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// health states of a server.
+const (
+	// server has not been health checked yet. becomes healthy after its first successful health check, and unhealthy after its first failed health check.
+	Starting = "starting"
+	// server receives traffic. becomes unhealthy after fall consecutive failed health checks.
+	Healthy = "healthy"
+	// server does not receive traffic. becomes healthy after rise consecutive successful health checks.
+	Unhealthy = "unhealthy"
+	// server asked to stop receiving new traffic, by responding to a health check with a drain status code.
+	Draining = "draining"
+)
+
+// returned by a health check when the server responds with a drain status code.
+var ErrDraining = errors.New("server is draining")
+
+// HealthTransition describes a change in the health state of a server.
+type HealthTransition struct {
+	From   string
+	To     string
+	Reason string
+	Time   time.Time
+}
+
+func (ht HealthTransition) String() string {
+	return fmt.Sprintf("health state changed from %s to %s : %s", ht.From, ht.To, ht.Reason)
+}
+
+/*
+HealthState is the health state machine of a server.
+Consecutive successful/failed health checks are counted, so that a server does not flap between healthy and unhealthy due to a single health check.
+*/
+type HealthState struct {
+	status string
+
+	rise int // number of consecutive successful health checks required to become healthy.
+	fall int // number of consecutive failed health checks required to become unhealthy.
+
+	consecutiveSuccesses int
+	consecutiveFailures  int
+
+	lastTransition HealthTransition
+
+	mutex *sync.Mutex
+}
+
+func InitializeHealthState(rise int, fall int) *HealthState {
+
+	return &HealthState{
+		status: Starting,
+		rise:   rise,
+		fall:   fall,
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (hs *HealthState) Status() string {
+
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return hs.status
+}
+
+// LastTransition returns the most recent change in health state, or false if the state has not changed since the server was configured.
+func (hs *HealthState) LastTransition() (HealthTransition, bool) {
+
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return hs.lastTransition, !hs.lastTransition.Time.IsZero()
+}
+
+// must be called with mutex held.
+func (hs *HealthState) transition(to string, reason string) (HealthTransition, bool) {
+
+	if hs.status == to {
+		return HealthTransition{}, false
+	}
+
+	hs.lastTransition = HealthTransition{From: hs.status, To: to, Reason: reason, Time: time.Now()}
+	hs.status = to
+	hs.consecutiveSuccesses = 0
+	hs.consecutiveFailures = 0
+
+	return hs.lastTransition, true
+}
+
+// SetStatus changes the health state of the server, irrespective of health check results.
+func (hs *HealthState) SetStatus(status string, reason string) (HealthTransition, bool) {
+
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return hs.transition(status, reason)
+}
+
+/*
+RecordCheck updates the health state using the result of a health check, err is nil if the health check succeeded.
+Returns the transition, and true if the health state changed.
+*/
+func (hs *HealthState) RecordCheck(err error) (HealthTransition, bool) {
+
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	if errors.Is(err, ErrDraining) {
+		return hs.transition(Draining, "server responded with drain status")
+	}
+
+	if err != nil {
+
+		hs.consecutiveSuccesses = 0
+		hs.consecutiveFailures++
+
+		if hs.status == Starting || (hs.status != Unhealthy && hs.consecutiveFailures >= hs.fall) {
+			return hs.transition(Unhealthy, fmt.Sprintf("%d consecutive failed health checks, last error : %s", hs.consecutiveFailures, err.Error()))
+		}
+		return HealthTransition{}, false
+	}
+
+	hs.consecutiveFailures = 0
+	hs.consecutiveSuccesses++
+
+	if hs.status == Starting || (hs.status != Healthy && hs.consecutiveSuccesses >= hs.rise) {
+		return hs.transition(Healthy, fmt.Sprintf("%d consecutive successful health checks", hs.consecutiveSuccesses))
+	}
+	return HealthTransition{}, false
+}
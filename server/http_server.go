@@ -1,13 +1,11 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +17,7 @@ import (
 type HTTPServer struct {
 	Addr     string
 	ServerId int
+	Name     string // identifies the server in affinity cookies, shared with the websocket server of the same backend. Defaults to Addr.
 
 	MaxWorkerCount int
 	MinWorkerCount int
@@ -27,6 +26,21 @@ type HTTPServer struct {
 	WorkerCount      *int
 	WorkerCountMutex *sync.Mutex
 
+	PreserveHost bool // if true, Host header of the user's request is passed through to the server.
+
+	Weight    int             // share of traffic received by the server, relative to other servers. Servers with weight 0 do not receive traffic.
+	SlowStart SlowStartConfig // weight of the server is increased gradually after it recovers.
+
+	HealthCheck HealthCheckConfig
+	Health      *HealthState
+
+	OutlierDetector    *OutlierDetector    // shared by all servers of the pool, ejects servers based on failures observed in live traffic.
+	CircuitBreaker     *CircuitBreaker     // stops requests from being sent to the server while it is degraded.
+	ConcurrencyLimiter *ConcurrencyLimiter // limits the number of requests sent to the server at the same time, and the number of workers spawned.
+
+	ActiveJobs      *int // number of jobs that have been assigned to the server, but not completed yet.
+	ActiveJobsMutex *sync.Mutex
+
 	JobChannel chan Job
 
 	Logger *log.Logger
@@ -34,44 +48,120 @@ type HTTPServer struct {
 
 type HTTPWorker struct {
 	Addr     string
+	ServerId int
 	WorkerId int
 	Timeout  int
 
 	JobChannel <-chan Job
 
-	WorkerCount      *int
-	WorkerCountMutex *sync.Mutex
-	MinWorkerCount   int
-	HTTPClient       http.Client
+	WorkerCount        *int
+	WorkerCountMutex   *sync.Mutex
+	MinWorkerCount     int
+	HTTPClient         http.Client
+	PreserveHost       bool
+	OutlierDetector    *OutlierDetector
+	CircuitBreaker     *CircuitBreaker
+	ConcurrencyLimiter *ConcurrencyLimiter
 
 	logger *log.Logger
 }
 
+/*
+Job is a request assigned to a worker. The worker sends a copy of the request to the server, and sends the result back on the Result channel.
+The worker then waits for the Done channel to be closed, which happens once the response body has been copied to the user,
+so that the connection of the worker is not reused while the response is being read.
+*/
 type Job struct {
-	ResponseWriter http.ResponseWriter
-	Request        *http.Request
-	Done           chan struct{}
+	Context context.Context // request sent to the server is cancelled when Context is cancelled, eg: when the user disconnects. jobs cancelled while queued are dropped.
+	Request *http.Request
+
+	ConnectTimeout        time.Duration // maximum time to establish a new connection to the server. 0 disables the timeout.
+	ResponseHeaderTimeout time.Duration // maximum time to wait for response headers. 0 disables the timeout.
+
+	CircuitPermit CircuitPermit // returned by the circuit breaker of the server when the request was admitted.
+
+	Result chan JobResult // should be buffered, so that the worker never blocks on sending the result.
+	Done   chan struct{}
 }
 
-func InitializeHTTPServer(serverAddr string, serverId int, workerTimeout int, minWorkerCount int, maxWorkerCount int, bufferSize int) HTTPServer {
+// JobResult contains the response of the server to a job, or the error that occured while sending the request.
+type JobResult struct {
+	Response *http.Response
+	Err      error
+}
+
+func InitializeJob(ctx context.Context, r *http.Request, connectTimeout time.Duration, responseHeaderTimeout time.Duration) Job {
+
+	return Job{
+		Context:               ctx,
+		Request:               r,
+		ConnectTimeout:        connectTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		Result:                make(chan JobResult, 1),
+		Done:                  make(chan struct{}),
+	}
+}
+
+// HTTPServerConfig contains the configuration of a single HTTP server, read from the [http] section.
+type HTTPServerConfig struct {
+	Addr     string
+	ServerId int
+	Name     string
+
+	MaxWorkerCount int
+	MinWorkerCount int
+	WorkerTimeout  int
+	BufferSize     int
+
+	PreserveHost bool
+	Weight       int
+	SlowStart    SlowStartConfig
+
+	HealthCheck      HealthCheckConfig
+	OutlierDetector  *OutlierDetector
+	CircuitBreaker   CircuitBreakerConfig
+	ConcurrencyLimit ConcurrencyLimitConfig
+	JobQueue         JobQueueConfig
+}
+
+// section level keys of the [http] section, which do not configure a single server.
+var httpSectionKeys = concatKeys([]string{"algorithm", "enable_health_check", "health_check_interval", "hash_key", "hash_bounded_load", "host_header"}, healthCheckKeys, outlierDetectionKeys, circuitBreakerKeys, slowStartKeys, retryPolicyKeys, timeoutKeys, concurrencyLimitKeys, jobQueueKeys)
+
+// keys used to configure a single server in the [http] section, of the form server{number}_{config_name}.
+var httpServerKeys = append([]string{"addr", "name", "max_workers", "min_workers", "worker_timeout", "buffer_size", "weight"}, healthCheckKeys...)
 
-	wc := 1
+func InitializeHTTPServer(cfg HTTPServerConfig) HTTPServer {
+
+	wc := cfg.MinWorkerCount
+	activeJobs := 0
+	logger := log.New(os.Stdout, fmt.Sprintf("HTTP SERVER %d :     ", cfg.ServerId), 0)
 	hs := HTTPServer{
-		Addr:             serverAddr,
-		ServerId:         serverId,
-		JobChannel:       make(chan Job, bufferSize),
-		Logger:           log.New(os.Stdout, fmt.Sprintf("HTTP SERVER %d :     ", serverId), 0),
-		WorkerTimeout:    workerTimeout,
-		MaxWorkerCount:   maxWorkerCount,
-		MinWorkerCount:   minWorkerCount,
-		WorkerCount:      &wc,
-		WorkerCountMutex: &sync.Mutex{},
+		Addr:               cfg.Addr,
+		ServerId:           cfg.ServerId,
+		Name:               cfg.Name,
+		JobChannel:         make(chan Job, cfg.BufferSize),
+		Logger:             logger,
+		WorkerTimeout:      cfg.WorkerTimeout,
+		MaxWorkerCount:     cfg.MaxWorkerCount,
+		MinWorkerCount:     cfg.MinWorkerCount,
+		WorkerCount:        &wc,
+		WorkerCountMutex:   &sync.Mutex{},
+		PreserveHost:       cfg.PreserveHost,
+		Weight:             cfg.Weight,
+		SlowStart:          cfg.SlowStart,
+		HealthCheck:        cfg.HealthCheck,
+		Health:             InitializeHealthState(cfg.HealthCheck.Rise, cfg.HealthCheck.Fall),
+		OutlierDetector:    cfg.OutlierDetector,
+		CircuitBreaker:     InitializeCircuitBreaker(cfg.CircuitBreaker, cfg.ServerId, logger),
+		ConcurrencyLimiter: InitializeConcurrencyLimiter(cfg.ConcurrencyLimit, cfg.ServerId, cfg.MinWorkerCount, cfg.MaxWorkerCount, InitializePriorityQueue(cfg.JobQueue, cfg.BufferSize, cfg.ServerId), cfg.JobQueue.MaxWait, logger),
+		ActiveJobs:         &activeJobs,
+		ActiveJobsMutex:    &sync.Mutex{},
 	}
 
-	for workerId := 1; workerId <= minWorkerCount; workerId++ {
+	for workerId := 1; workerId <= cfg.MinWorkerCount; workerId++ {
 
 		worker := hs.SpawnHTTPWorker(workerId, hs.MinWorkerCount, hs.WorkerTimeout, hs.Logger, hs.WorkerCount, hs.WorkerCountMutex)
-		hs.Logger.Printf("Server %d spawning Worker %d...", serverId, workerId)
+		hs.Logger.Printf("Server %d spawning Worker %d...", cfg.ServerId, workerId)
 		go worker.ProcessHTTPRequest()
 	}
 
@@ -83,168 +173,266 @@ func ConfigureHTTPServers(httpSection ini.Section) ([]HTTPServer, error) {
 
 	httpServerPool := make([]HTTPServer, 0)
 
-	serverId := 1
+	preserveHost := false
 
-	var srvAddr string
-	maxWorkers := 3    // default number of max workers
-	minWorkers := 1    // default number of min workers
-	bufferSize := 10   // default value of buffer size
-	workerTimeout := 3 // default value for worker timeout
-	addrConfigured := false
+	switch hostHeader := strings.ToLower(httpSection["host_header"]); hostHeader {
+	case "", "rewrite":
+		preserveHost = false
+	case "pass-through":
+		preserveHost = true
+	default:
+		return nil, fmt.Errorf("invalid config, http.host_header should be pass-through/rewrite")
+	}
 
-	keysList := make([]string, 0)
+	sectionHealthCheck, err := ConfigureHealthCheck(httpSection, DefaultHealthCheckConfig(), "http.")
 
-	for key := range httpSection {
-		keysList = append(keysList, key)
+	if err != nil {
+		return nil, err
 	}
 
-	sort.Strings(keysList)
+	serverConfigs, serverIds, err := groupNumberedKeys(httpSection, "http", "server", httpSectionKeys, "route")
 
-	for _, key := range keysList {
+	if err != nil {
+		return nil, fmt.Errorf("%s\n\nformat for http section:\n\n[http]\nserver{number}_{config_name}={config}", err.Error())
+	}
 
-		val := httpSection[key]
-		// Only process keys with the prefix "server"
+	outlierDetectionConfig, err := ConfigureOutlierDetection(httpSection, "http")
 
-		if key == "algorithm" || key == "enable_health_check" || key == "health_check_interval" {
-			continue
-		}
-		if !strings.HasPrefix(key, "server") {
-			return nil, fmt.Errorf("format for http section:\n\n[http]\nserver{number}_{config_name}={config}")
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		log.Printf("server being configured %c", key[6])
-		currServerId := int(key[6] - '0')
+	outlierDetector := InitializeOutlierDetector(outlierDetectionConfig, serverIds, "HTTP OUTLIER DETECTOR : ")
 
-		if serverId != currServerId {
-			log.Printf("current server id %d", currServerId)
-			if !addrConfigured {
-				return nil, fmt.Errorf("invalid config, value of server%d_addr cannot be empty", serverId)
-			}
+	circuitBreakerConfig, err := ConfigureCircuitBreaker(httpSection, "http")
 
-			log.Printf("HTTP server %d configured with addr : %s worker timeout : %d max workers : %d min workers : %d buffer size : %d", serverId, srvAddr, workerTimeout, maxWorkers, minWorkers, bufferSize)
-			httpServerPool = append(httpServerPool, InitializeHTTPServer(srvAddr, serverId, workerTimeout, minWorkers, maxWorkers, bufferSize))
-			serverId = currServerId
+	if err != nil {
+		return nil, err
+	}
 
-			// Reset default values for the next server
-			maxWorkers = 3    // default number of max workers
-			minWorkers = 1    // default number of min workers
-			bufferSize = 10   // default value of buffer size
-			workerTimeout = 3 // default value for worker timeout
-			addrConfigured = false
-		}
+	slowStart, err := ConfigureSlowStart(httpSection, "http")
 
-		// Process the key to set the appropriate variables
-		if strings.HasSuffix(key, "addr") {
-			srvAddr = val
-			addrConfigured = true
+	if err != nil {
+		return nil, err
+	}
 
-		} else if strings.HasSuffix(key, "max_workers") {
-			var err error
-			maxWorkers, err = strconv.Atoi(val)
-			if err != nil {
-				return nil, fmt.Errorf("invalid config, server%d_max_workers value must be a valid integer", serverId)
-			}
+	concurrencyLimit, err := ConfigureConcurrencyLimit(httpSection, "http")
 
-		} else if strings.HasSuffix(key, "min_workers") {
+	if err != nil {
+		return nil, err
+	}
 
-			var err error
-			minWorkers, err = strconv.Atoi(val)
-			if err != nil {
-				return nil, fmt.Errorf("invalid config, server%d_max_workers value must be a valid integer", serverId)
-			}
+	jobQueue, err := ConfigureJobQueue(httpSection, "http")
 
-		} else if strings.HasSuffix(key, "worker_timeout") {
-			var err error
-			workerTimeout, err = strconv.Atoi(val)
-			if err != nil {
-				return nil, fmt.Errorf("invalid config, server%d_worker_timeout value must be a valid integer", serverId)
-			}
-		} else if strings.HasSuffix(key, "buffer_size") {
+	if err != nil {
+		return nil, err
+	}
+
+	for _, serverId := range serverIds {
+
+		config := serverConfigs[serverId]
+
+		srvAddr := config["addr"]
 
-			var err error
-			bufferSize, err = strconv.Atoi(val)
-			if err != nil {
-				return nil, fmt.Errorf("invalid config, server%d_buffer_size value must be a valid integer", serverId)
+		if srvAddr == "" {
+			return nil, fmt.Errorf("invalid config, value of server%d_addr cannot be empty", serverId)
+		}
+
+		for configName := range config {
+			if !containsKey(configName, httpServerKeys) {
+				return nil, fmt.Errorf("invalid config, unknown key server%d_%s", serverId, configName)
 			}
 		}
+
+		cfg := HTTPServerConfig{Addr: srvAddr, ServerId: serverId, Name: serverName(config, srvAddr), PreserveHost: preserveHost, OutlierDetector: outlierDetector, CircuitBreaker: circuitBreakerConfig, SlowStart: slowStart, ConcurrencyLimit: concurrencyLimit, JobQueue: jobQueue}
+
+		if cfg.MaxWorkerCount, err = parseServerIntConfig(config, "max_workers", serverId, 3); err != nil { // default number of max workers
+			return nil, err
+		}
+		if cfg.MinWorkerCount, err = parseServerIntConfig(config, "min_workers", serverId, 1); err != nil { // default number of min workers
+			return nil, err
+		}
+		if cfg.MaxWorkerCount == 0 || cfg.MinWorkerCount > cfg.MaxWorkerCount {
+			return nil, fmt.Errorf("invalid config, server%d_max_workers should be positive, and not less than server%d_min_workers", serverId, serverId)
+		}
+		if cfg.WorkerTimeout, err = parseServerIntConfig(config, "worker_timeout", serverId, 3); err != nil { // default value for worker timeout
+			return nil, err
+		}
+		if cfg.BufferSize, err = parseServerIntConfig(config, "buffer_size", serverId, 10); err != nil { // default value of buffer size
+			return nil, err
+		}
+		if cfg.Weight, err = parseServerIntConfig(config, "weight", serverId, 1); err != nil { // default weight
+			return nil, err
+		}
+		if cfg.HealthCheck, err = ConfigureHealthCheck(config, sectionHealthCheck, fmt.Sprintf("server%d_", serverId)); err != nil {
+			return nil, err
+		}
+
+		log.Printf("HTTP server %d configured with addr : %s worker timeout : %d max workers : %d min workers : %d buffer size : %d weight : %d", serverId, cfg.Addr, cfg.WorkerTimeout, cfg.MaxWorkerCount, cfg.MinWorkerCount, cfg.BufferSize, cfg.Weight)
+		httpServerPool = append(httpServerPool, InitializeHTTPServer(cfg))
 	}
 
-	//handling last server to be configured
-	if addrConfigured {
-		log.Printf("HTTP server %d configured with addr : %s worker timeout : %d max workers : %d min workers : %d buffer size : %d", serverId, srvAddr, workerTimeout, maxWorkers, minWorkers, bufferSize)
-		httpServerPool = append(httpServerPool, InitializeHTTPServer(srvAddr, serverId, workerTimeout, minWorkers, maxWorkers, bufferSize))
-	} else {
-		return nil, fmt.Errorf("invalid config, value of server%d_addr cannot be empty", serverId)
+	if len(httpServerPool) == 0 {
+		return nil, fmt.Errorf("invalid config, value of server1_addr cannot be empty")
 	}
 
 	return httpServerPool, nil
 }
 
+func (hs *HTTPServer) IncrementActiveJobs() {
+
+	hs.ActiveJobsMutex.Lock()
+	*hs.ActiveJobs++
+	hs.ActiveJobsMutex.Unlock()
+}
+
+func (hs *HTTPServer) DecrementActiveJobs() {
+
+	hs.ActiveJobsMutex.Lock()
+	*hs.ActiveJobs--
+	hs.ActiveJobsMutex.Unlock()
+}
+
+func (hs *HTTPServer) GetActiveJobs() int {
+
+	hs.ActiveJobsMutex.Lock()
+	defer hs.ActiveJobsMutex.Unlock()
+	return *hs.ActiveJobs
+}
+
+// IsAvailable returns false if the server has been temporarily taken out of the pool, based on failures observed in live traffic.
+func (hs *HTTPServer) IsAvailable() bool {
+
+	return !hs.OutlierDetector.IsEjected(hs.ServerId)
+}
+
+// SlowStartFactor returns the fraction of its full weight that the server currently receives, which is less than 1 while the server is in slow start.
+func (hs *HTTPServer) SlowStartFactor() float64 {
+
+	return hs.SlowStart.Factor(recoveredAt(hs.Health, hs.OutlierDetector, hs.ServerId), time.Now())
+}
+
 func (hs *HTTPServer) SpawnHTTPWorker(workerId int, minWorkerCount int, timeout int, lgr *log.Logger, workerCount *int, workerCountMutex *sync.Mutex) *HTTPWorker {
 
 	client := util.InitializeWorkerHTTPClient(lgr, workerId)
 
 	return &HTTPWorker{
-		Addr:             hs.Addr,
-		WorkerId:         workerId,
-		MinWorkerCount:   minWorkerCount,
-		JobChannel:       hs.JobChannel,
-		HTTPClient:       client,
-		logger:           lgr,
-		Timeout:          timeout,
-		WorkerCount:      workerCount,
-		WorkerCountMutex: workerCountMutex,
+		Addr:               hs.Addr,
+		ServerId:           hs.ServerId,
+		WorkerId:           workerId,
+		MinWorkerCount:     minWorkerCount,
+		JobChannel:         hs.JobChannel,
+		HTTPClient:         client,
+		logger:             lgr,
+		Timeout:            timeout,
+		WorkerCount:        workerCount,
+		WorkerCountMutex:   workerCountMutex,
+		PreserveHost:       hs.PreserveHost,
+		OutlierDetector:    hs.OutlierDetector,
+		CircuitBreaker:     hs.CircuitBreaker,
+		ConcurrencyLimiter: hs.ConcurrencyLimiter,
 	}
 }
 
 /*
-Worker waits to be assigned a Job, by listening to the Job channel.
-Then creates a copy of the request, sends it to the server, and writes response back to the ResponseWriter.
+ScaleWorkers spawns workers until there is a worker for every request in flight, up to the maximum number of workers.
+Since the concurrency limiter never admits more requests than the maximum number of workers, every admitted job is received by a worker without waiting for another job to complete.
+Idle workers exit after the worker timeout, down to the minimum number of workers.
 */
-func (hw *HTTPWorker) ProcessHTTPRequest() {
-	for {
+func (hs *HTTPServer) ScaleWorkers() {
 
-		select {
+	inFlight := hs.ConcurrencyLimiter.InFlight()
 
-		case req := <-hw.JobChannel:
-			hw.logger.Printf("worker %d received a task... ", hw.WorkerId)
+	hs.WorkerCountMutex.Lock()
+	defer hs.WorkerCountMutex.Unlock()
 
-			newReq, err := util.CopyRequest(req.Request, hw.Addr)
+	for *hs.WorkerCount < min(inFlight, hs.MaxWorkerCount) {
 
-			if err != nil {
-				hw.logger.Printf("Worker %d -> error : %s", hw.WorkerId, err.Error())
-				util.WriteJSON(req.ResponseWriter, 500, map[string]string{"error": "internal server error"})
-				continue
-			}
+		*hs.WorkerCount++
+		workerId := *hs.WorkerCount
 
-			resp, err := hw.HTTPClient.Do(newReq)
+		hs.Logger.Printf("Server %d spawning Worker %d...", hs.ServerId, workerId)
+		newWorker := hs.SpawnHTTPWorker(workerId, hs.MinWorkerCount, hs.WorkerTimeout, hs.Logger, hs.WorkerCount, hs.WorkerCountMutex)
+		go newWorker.ProcessHTTPRequest()
+	}
+}
 
-			if resp == nil {
-				hw.logger.Printf("Worker %d -> error : response is nil", hw.WorkerId)
-				util.WriteJSON(req.ResponseWriter, 500, map[string]string{"error": "internal server error"})
-				continue
-			}
+/*
+HandleJob sends a copy of the job's request to the server, and sends the response (or error) back on the job's Result channel.
+The outcome and latency of the request are recorded by the outlier detector and circuit breaker of the server.
+*/
+func (hw *HTTPWorker) HandleJob(job Job) {
+
+	// the user disconnected, or the request timed out, while the job was queued.
+	if err := job.Context.Err(); err != nil {
+		hw.logger.Printf("Worker %d -> dropped job cancelled while queued : %s", hw.WorkerId, err.Error())
+		hw.CircuitBreaker.RecordResult(job.CircuitPermit, Ignored, 0)
+		job.Result <- JobResult{Err: err}
+		<-job.Done
+		return
+	}
 
-			if err != nil {
-				hw.logger.Printf("Worker %d -> error : %s", hw.WorkerId, err.Error())
-				util.WriteJSON(req.ResponseWriter, 500, map[string]string{"error": "internal server error"})
-				resp.Body.Close()
-				continue
-			}
+	newReq, err := util.CopyRequest(job.Request, hw.Addr, hw.PreserveHost)
+
+	if err != nil {
+		hw.logger.Printf("Worker %d -> error : %s", hw.WorkerId, err.Error())
+		hw.CircuitBreaker.RecordResult(job.CircuitPermit, Ignored, 0)
+		job.Result <- JobResult{Err: err}
+		<-job.Done
+		return
+	}
+
+	ctx, cancel := context.WithCancel(util.WithConnectTimeout(job.Context, job.ConnectTimeout))
+	defer cancel()
 
-			respBody, err := io.ReadAll(resp.Body)
+	// the timeout only applies until response headers are received, the body is streamed until the job's context is done.
+	var timer *time.Timer
+	if job.ResponseHeaderTimeout > 0 {
+		timer = time.AfterFunc(job.ResponseHeaderTimeout, cancel)
+	}
+
+	start := time.Now()
+	resp, err := hw.HTTPClient.Do(newReq.WithContext(ctx))
+	latency := time.Since(start)
+
+	if timer != nil && !timer.Stop() {
+		if err == nil {
 			resp.Body.Close()
+		}
+		err = fmt.Errorf("%w, no response from server within %s", ErrResponseHeaderTimeout, job.ResponseHeaderTimeout)
+	}
 
-			if err != nil {
-				hw.logger.Printf("Worker %d -> error : %s", hw.WorkerId, err.Error())
-				util.WriteJSON(req.ResponseWriter, 500, map[string]string{"error": "internal server error"})
-				resp.Body.Close()
-				continue
-			}
+	if err != nil {
+		hw.logger.Printf("Worker %d -> error : %s", hw.WorkerId, err.Error())
+		hw.OutlierDetector.RecordOutcome(hw.ServerId, ClassifyError(err))
+		hw.CircuitBreaker.RecordResult(job.CircuitPermit, ClassifyError(err), latency)
+		hw.ConcurrencyLimiter.RecordResult(ClassifyError(err), latency)
+		job.Result <- JobResult{Err: err}
+		<-job.Done
+		return
+	}
+
+	hw.OutlierDetector.RecordOutcome(hw.ServerId, ClassifyStatus(resp.StatusCode))
+	hw.CircuitBreaker.RecordResult(job.CircuitPermit, ClassifyStatus(resp.StatusCode), latency)
+	hw.ConcurrencyLimiter.RecordResult(ClassifyStatus(resp.StatusCode), latency)
+
+	job.Result <- JobResult{Response: resp}
+	<-job.Done
+}
 
-			util.WriteResponse(req.ResponseWriter, resp.StatusCode, respBody)
+/*
+Worker waits to be assigned a Job, by listening to the Job channel.
+Then creates a copy of the request, sends it to the server, and sends the response back to the handler.
+*/
+func (hw *HTTPWorker) ProcessHTTPRequest() {
+	for {
+
+		select {
+
+		case job := <-hw.JobChannel:
+			hw.logger.Printf("worker %d received a task... ", hw.WorkerId)
 
-			close(req.Done)
+			hw.HandleJob(job)
 
 		case <-time.After(time.Duration(hw.Timeout) * time.Second):
 
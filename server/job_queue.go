@@ -0,0 +1,418 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/metrics"
+	"github.com/gookit/ini/v2"
+)
+
+// priority classes of queued requests. Requests of a higher class are always admitted before requests of a lower class.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// priority classes, from highest to lowest priority.
+var priorityClasses = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// keys used to configure the queue of requests waiting for a server at section level.
+var jobQueueKeys = []string{
+	"queue",
+	"queue_max_wait",
+	"queue_priority_header",
+	"queue_limit_high",
+	"queue_limit_normal",
+	"queue_limit_low",
+	"fair_queue_key",
+	"fair_queue_weights",
+}
+
+var (
+	// returned when a request cannot be queued, as the queue of the server or of its priority class is full.
+	ErrQueueFull = errors.New("queue of the server is full")
+	// returned when a request is not admitted by the server within the maximum queue wait time.
+	ErrQueueTimeout = errors.New("maximum queue wait time exceeded")
+)
+
+type JobQueueConfig struct {
+	Type           string         // fifo, or fair (weighted fair queuing between users).
+	MaxWait        time.Duration  // maximum time a request waits in the queue. 0 disables queuing, requests above the concurrency limit are rejected.
+	PriorityHeader string         // header of the request containing its priority class. Requests without a valid priority are normal priority.
+	ClassLimits    map[string]int // maximum number of queued requests of a priority class. 0 only limits the class by the size of the queue.
+	FlowWeights    map[string]int // weight of a user when using fair queuing, by fair queue key. Users not listed have weight 1.
+}
+
+func ConfigureJobQueue(section ini.Section, sectionName string) (JobQueueConfig, error) {
+
+	cfg := JobQueueConfig{ClassLimits: make(map[string]int), FlowWeights: make(map[string]int)}
+
+	switch queueType := strings.ToLower(section["queue"]); queueType {
+	case "", "fifo":
+		cfg.Type = "fifo"
+	case "fair":
+		cfg.Type = "fair"
+	default:
+		return cfg, fmt.Errorf("invalid config, %s.queue should be fifo/fair", sectionName)
+	}
+
+	maxWait, err := parseSectionIntConfig(section, "queue_max_wait", sectionName, 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxWait = time.Duration(maxWait) * time.Millisecond
+
+	cfg.PriorityHeader = section["queue_priority_header"]
+
+	for _, class := range priorityClasses {
+		if cfg.ClassLimits[class], err = parseSectionIntConfig(section, "queue_limit_"+class, sectionName, 0); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, field := range strings.Split(section["fair_queue_weights"], ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		key, weightString, found := strings.Cut(field, ":")
+		weight, err := strconv.Atoi(weightString)
+		if !found || key == "" || err != nil || weight <= 0 {
+			return cfg, fmt.Errorf("invalid config, %s.fair_queue_weights should be a comma separated list of {key}:{positive weight}, eg: tenant-a:3,tenant-b:1", sectionName)
+		}
+		cfg.FlowWeights[key] = weight
+	}
+
+	return cfg, nil
+}
+
+// ParsePriority returns the priority class named by val, or false if val is not a priority class.
+func ParsePriority(val string) (string, bool) {
+
+	val = strings.ToLower(strings.TrimSpace(val))
+	return val, slices.Contains(priorityClasses, val)
+}
+
+// QueueEntry is a request waiting in the queue of a server, until it is admitted by the server's concurrency limiter.
+type QueueEntry struct {
+	Class   string // priority class of the request.
+	FlowKey string // identifies the user sending the request, when using fair queuing.
+
+	finish   float64 // virtual finish time of the request, when using fair queuing.
+	sequence uint64  // order in which the request was queued.
+
+	admitted   chan struct{} // closed when the request is admitted.
+	isAdmitted bool
+	evicted    chan struct{} // closed when the request is rejected after being queued, to make room for a request of another user.
+	isEvicted  bool
+}
+
+func InitializeQueueEntry(class string, flowKey string) *QueueEntry {
+
+	return &QueueEntry{Class: class, FlowKey: flowKey, admitted: make(chan struct{}), evicted: make(chan struct{})}
+}
+
+// JobQueue orders the requests of a single priority class.
+type JobQueue interface {
+	Push(entry *QueueEntry)
+	Pop() *QueueEntry // returns nil if the queue is empty.
+	Remove(entry *QueueEntry)
+	Len() int
+	Entries() []*QueueEntry // queued requests, in the order in which they were queued.
+}
+
+func newJobQueue(cfg JobQueueConfig) JobQueue {
+
+	if cfg.Type == "fair" {
+		return &fairQueue{weights: cfg.FlowWeights, lastFinish: make(map[string]float64)}
+	}
+	return &fifoQueue{}
+}
+
+// fifoQueue admits requests in the order in which they were queued.
+type fifoQueue struct {
+	entries []*QueueEntry
+}
+
+func (fq *fifoQueue) Push(entry *QueueEntry) {
+
+	fq.entries = append(fq.entries, entry)
+}
+
+func (fq *fifoQueue) Pop() *QueueEntry {
+
+	if len(fq.entries) == 0 {
+		return nil
+	}
+	entry := fq.entries[0]
+	fq.entries[0] = nil
+	fq.entries = fq.entries[1:]
+	return entry
+}
+
+func (fq *fifoQueue) Remove(entry *QueueEntry) {
+
+	if index := slices.Index(fq.entries, entry); index != -1 {
+		fq.entries = slices.Delete(fq.entries, index, index+1)
+	}
+}
+
+func (fq *fifoQueue) Len() int {
+
+	return len(fq.entries)
+}
+
+func (fq *fifoQueue) Entries() []*QueueEntry {
+
+	return fq.entries
+}
+
+/*
+fairQueue admits requests using weighted fair queuing, so that users sending many requests do not delay users sending fewer requests.
+Each request is given a virtual finish time, which is 1/weight after the finish time of the previous request of the same user,
+and the request with the earliest virtual finish time is admitted first. A user with weight 2 is admitted twice as often as a user with weight 1.
+*/
+type fairQueue struct {
+	weights map[string]int
+
+	entries     []*QueueEntry
+	virtualTime float64            // virtual finish time of the last admitted request.
+	lastFinish  map[string]float64 // virtual finish time of the last queued request of each user.
+}
+
+func (fq *fairQueue) Push(entry *QueueEntry) {
+
+	weight := 1
+	if w, ok := fq.weights[entry.FlowKey]; ok {
+		weight = w
+	}
+
+	entry.finish = max(fq.virtualTime, fq.lastFinish[entry.FlowKey]) + 1/float64(weight)
+	fq.lastFinish[entry.FlowKey] = entry.finish
+	fq.entries = append(fq.entries, entry)
+}
+
+func (fq *fairQueue) Pop() *QueueEntry {
+
+	if len(fq.entries) == 0 {
+		return nil
+	}
+
+	// entries are in the order in which they were queued, so ties are admitted in that order.
+	next := 0
+	for index, entry := range fq.entries {
+		if entry.finish < fq.entries[next].finish {
+			next = index
+		}
+	}
+
+	entry := fq.entries[next]
+	fq.entries = slices.Delete(fq.entries, next, next+1)
+	fq.virtualTime = entry.finish
+
+	if fq.lastFinish[entry.FlowKey] <= fq.virtualTime {
+		delete(fq.lastFinish, entry.FlowKey)
+	}
+	if len(fq.entries) == 0 {
+		fq.virtualTime = 0
+		clear(fq.lastFinish)
+	}
+	return entry
+}
+
+// Remove removes a request which was not admitted. The finish time of its user is rolled back, so that the user is not penalised for requests that were never admitted.
+func (fq *fairQueue) Remove(entry *QueueEntry) {
+
+	if index := slices.Index(fq.entries, entry); index != -1 {
+		fq.entries = slices.Delete(fq.entries, index, index+1)
+	}
+
+	delete(fq.lastFinish, entry.FlowKey)
+	for _, queued := range fq.entries {
+		if queued.FlowKey == entry.FlowKey && queued.finish > fq.lastFinish[entry.FlowKey] {
+			fq.lastFinish[entry.FlowKey] = queued.finish
+		}
+	}
+
+	if len(fq.entries) == 0 {
+		fq.virtualTime = 0
+		clear(fq.lastFinish)
+	}
+}
+
+func (fq *fairQueue) Len() int {
+
+	return len(fq.entries)
+}
+
+func (fq *fairQueue) Entries() []*QueueEntry {
+
+	return fq.entries
+}
+
+// PriorityQueue contains a JobQueue for each priority class. It is not safe for concurrent use, and is guarded by the mutex of the concurrency limiter.
+type PriorityQueue struct {
+	config   JobQueueConfig
+	capacity int // maximum number of queued requests, across every priority class.
+	serverId int
+
+	classes  map[string]JobQueue
+	length   int
+	sequence uint64 // sequence number of the last queued request.
+}
+
+func InitializePriorityQueue(cfg JobQueueConfig, capacity int, serverId int) *PriorityQueue {
+
+	pq := &PriorityQueue{config: cfg, capacity: capacity, serverId: serverId, classes: make(map[string]JobQueue)}
+
+	for _, class := range priorityClasses {
+		pq.classes[class] = newJobQueue(cfg)
+		pq.recordLengthMetric(class)
+	}
+	return pq
+}
+
+func (pq *PriorityQueue) recordLengthMetric(class string) {
+
+	metrics.SetGauge("proxy_http_queue_length", "number of requests waiting in the queue of a http server.", metrics.Labels{"server": strconv.Itoa(pq.serverId), "class": class}, float64(pq.classes[class].Len()))
+}
+
+func (pq *PriorityQueue) recordRejection(class string, reason string) {
+
+	metrics.AddCounter("proxy_http_queue_rejected_total", "number of requests rejected by the queue of a http server.", metrics.Labels{"server": strconv.Itoa(pq.serverId), "class": class, "reason": reason}, 1)
+}
+
+/*
+Push queues the request, or returns ErrQueueFull if the queue or the queue of its priority class is full.
+If only the queue is full, the newest request of the lowest priority class below the class of the request is rejected instead,
+so that higher priority requests keep flowing during overload.
+When using fair queuing, a full queue also rejects the newest request of the user with the most queued requests instead,
+if that user has queued at least 2 more requests than the user sending this request, so that a single user cannot fill the queue.
+*/
+func (pq *PriorityQueue) Push(entry *QueueEntry) error {
+
+	queue := pq.classes[entry.Class]
+	classFull := pq.config.ClassLimits[entry.Class] > 0 && queue.Len() >= pq.config.ClassLimits[entry.Class]
+
+	if pq.length >= pq.capacity || classFull {
+		evicted := !classFull && pq.evictLowerClass(entry)
+		if !evicted && pq.config.Type == "fair" {
+			evicted = pq.evictLargestFlow(entry, classFull)
+		}
+		if !evicted {
+			pq.recordRejection(entry.Class, "full")
+			return ErrQueueFull
+		}
+	}
+
+	pq.sequence++
+	entry.sequence = pq.sequence
+	queue.Push(entry)
+	pq.length++
+	pq.recordLengthMetric(entry.Class)
+	return nil
+}
+
+// evictLowerClass rejects the newest queued request of the lowest priority class below the class of entry. Returns false if no such request is queued.
+func (pq *PriorityQueue) evictLowerClass(entry *QueueEntry) bool {
+
+	lowerClasses := priorityClasses[slices.Index(priorityClasses, entry.Class)+1:]
+
+	for index := len(lowerClasses) - 1; index >= 0; index-- {
+
+		var newest *QueueEntry
+		for _, queued := range pq.classes[lowerClasses[index]].Entries() {
+			if newest == nil || queued.sequence > newest.sequence {
+				newest = queued
+			}
+		}
+		if newest != nil {
+			pq.evict(newest)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+evictLargestFlow rejects the newest queued request of the user with the most queued requests, to make room for entry.
+Only requests of the class of entry are considered if that class is full, otherwise requests of its class and lower classes are considered,
+so that requests of a higher class are never rejected for entry. Returns false if no request was rejected.
+*/
+func (pq *PriorityQueue) evictLargestFlow(entry *QueueEntry, classFull bool) bool {
+
+	classes := priorityClasses[slices.Index(priorityClasses, entry.Class):]
+	if classFull {
+		classes = []string{entry.Class}
+	}
+
+	backlog := make(map[string]int)
+	newest := make(map[string]*QueueEntry)
+
+	for _, class := range classes {
+		for _, queued := range pq.classes[class].Entries() {
+			backlog[queued.FlowKey]++
+			if newest[queued.FlowKey] == nil || queued.sequence > newest[queued.FlowKey].sequence {
+				newest[queued.FlowKey] = queued
+			}
+		}
+	}
+
+	var largest *QueueEntry
+	for flowKey, victim := range newest {
+		if largest == nil || backlog[flowKey] > backlog[largest.FlowKey] || (backlog[flowKey] == backlog[largest.FlowKey] && victim.sequence > largest.sequence) {
+			largest = victim
+		}
+	}
+
+	if largest == nil || largest.FlowKey == entry.FlowKey || backlog[largest.FlowKey] < backlog[entry.FlowKey]+2 {
+		return false
+	}
+
+	pq.evict(largest)
+	return true
+}
+
+// evict rejects a queued request to make room for another request, and counts it as a rejection of its priority class.
+func (pq *PriorityQueue) evict(victim *QueueEntry) {
+
+	pq.classes[victim.Class].Remove(victim)
+	pq.length--
+	pq.recordLengthMetric(victim.Class)
+	pq.recordRejection(victim.Class, "evicted")
+
+	victim.isEvicted = true
+	close(victim.evicted)
+}
+
+// Pop returns the next request of the highest priority class with queued requests, or nil if no request is queued.
+func (pq *PriorityQueue) Pop() *QueueEntry {
+
+	for _, class := range priorityClasses {
+		if entry := pq.classes[class].Pop(); entry != nil {
+			pq.length--
+			pq.recordLengthMetric(class)
+			return entry
+		}
+	}
+	return nil
+}
+
+// Remove removes a request which stopped waiting before being admitted.
+func (pq *PriorityQueue) Remove(entry *QueueEntry, reason string) {
+
+	pq.classes[entry.Class].Remove(entry)
+	pq.length--
+	pq.recordLengthMetric(entry.Class)
+	pq.recordRejection(entry.Class, reason)
+}
+
+func (pq *PriorityQueue) Len() int {
+
+	return pq.length
+}
@@ -0,0 +1,138 @@
+package server
+
+import "testing"
+
+func TestFairQueueRemoveRollsBackFinishTime(t *testing.T) {
+
+	fq := newJobQueue(JobQueueConfig{Type: "fair"})
+
+	a1 := InitializeQueueEntry(PriorityNormal, "a")
+	a2 := InitializeQueueEntry(PriorityNormal, "a")
+	a3 := InitializeQueueEntry(PriorityNormal, "a")
+	for _, entry := range []*QueueEntry{a1, a2, a3} {
+		fq.Push(entry)
+	}
+
+	// a2 and a3 time out while queued.
+	fq.Remove(a2)
+	fq.Remove(a3)
+
+	a4 := InitializeQueueEntry(PriorityNormal, "a")
+	fq.Push(a4)
+
+	if a4.finish != a1.finish+1 {
+		t.Fatalf("finish time of a4 = %v, want %v", a4.finish, a1.finish+1)
+	}
+
+	// once every request of a user has been removed, its next request is not penalised.
+	fq.Remove(a1)
+	fq.Remove(a4)
+
+	a5 := InitializeQueueEntry(PriorityNormal, "a")
+	fq.Push(a5)
+
+	if a5.finish != 1 {
+		t.Fatalf("finish time of a5 = %v, want 1", a5.finish)
+	}
+}
+
+func TestFairPriorityQueueEvictsLargestFlow(t *testing.T) {
+
+	pq := InitializePriorityQueue(JobQueueConfig{Type: "fair"}, 3, 1)
+
+	a1 := InitializeQueueEntry(PriorityNormal, "a")
+	a2 := InitializeQueueEntry(PriorityNormal, "a")
+	a3 := InitializeQueueEntry(PriorityNormal, "a")
+	for _, entry := range []*QueueEntry{a1, a2, a3} {
+		if err := pq.Push(entry); err != nil {
+			t.Fatalf("push returned error : %s", err.Error())
+		}
+	}
+
+	// the queue is full, the newest request of a makes room for b.
+	b1 := InitializeQueueEntry(PriorityNormal, "b")
+	if err := pq.Push(b1); err != nil {
+		t.Fatalf("push of b1 returned error : %s", err.Error())
+	}
+
+	select {
+	case <-a3.evicted:
+	default:
+		t.Fatal("a3 was not evicted")
+	}
+	if pq.Len() != 3 {
+		t.Fatalf("queue length = %d, want 3", pq.Len())
+	}
+
+	// a and b would only swap places, so the incoming request is rejected.
+	b2 := InitializeQueueEntry(PriorityNormal, "b")
+	if err := pq.Push(b2); err != ErrQueueFull {
+		t.Fatalf("push of b2 returned %v, want %v", err, ErrQueueFull)
+	}
+
+	// a request of the flow with the largest backlog is rejected.
+	a4 := InitializeQueueEntry(PriorityNormal, "a")
+	if err := pq.Push(a4); err != ErrQueueFull {
+		t.Fatalf("push of a4 returned %v, want %v", err, ErrQueueFull)
+	}
+
+	// higher priority requests are never evicted for lower priority requests.
+	hq := InitializePriorityQueue(JobQueueConfig{Type: "fair"}, 2, 1)
+	h1 := InitializeQueueEntry(PriorityHigh, "a")
+	h2 := InitializeQueueEntry(PriorityHigh, "a")
+	hq.Push(h1)
+	hq.Push(h2)
+	if err := hq.Push(InitializeQueueEntry(PriorityLow, "b")); err != ErrQueueFull {
+		t.Fatalf("push of low priority request returned %v, want %v", err, ErrQueueFull)
+	}
+}
+
+func TestPriorityQueueEvictsLowerClass(t *testing.T) {
+
+	for _, queueType := range []string{"fifo", "fair"} {
+		t.Run(queueType, func(t *testing.T) {
+
+			pq := InitializePriorityQueue(JobQueueConfig{Type: queueType}, 3, 1)
+
+			n1 := InitializeQueueEntry(PriorityNormal, "a")
+			l1 := InitializeQueueEntry(PriorityLow, "b")
+			l2 := InitializeQueueEntry(PriorityLow, "c")
+			for _, entry := range []*QueueEntry{n1, l1, l2} {
+				if err := pq.Push(entry); err != nil {
+					t.Fatalf("push returned error : %s", err.Error())
+				}
+			}
+
+			// the newest request of the lowest class makes room for the high priority request.
+			h1 := InitializeQueueEntry(PriorityHigh, "d")
+			if err := pq.Push(h1); err != nil {
+				t.Fatalf("push of high priority request returned error : %s", err.Error())
+			}
+			if !l2.isEvicted || l1.isEvicted || n1.isEvicted {
+				t.Fatalf("evicted n1=%v l1=%v l2=%v, want only l2", n1.isEvicted, l1.isEvicted, l2.isEvicted)
+			}
+
+			h2 := InitializeQueueEntry(PriorityHigh, "d")
+			if err := pq.Push(h2); err != nil {
+				t.Fatalf("push of high priority request returned error : %s", err.Error())
+			}
+			if !l1.isEvicted || n1.isEvicted {
+				t.Fatalf("evicted n1=%v l1=%v, want only l1", n1.isEvicted, l1.isEvicted)
+			}
+
+			// lower priority requests never make room by evicting higher classes.
+			if err := pq.Push(InitializeQueueEntry(PriorityLow, "e")); err != ErrQueueFull {
+				t.Fatalf("push of low priority request returned %v, want %v", err, ErrQueueFull)
+			}
+
+			if pq.Len() != 3 {
+				t.Fatalf("queue length = %d, want 3", pq.Len())
+			}
+			for _, want := range []*QueueEntry{h1, h2, n1} {
+				if got := pq.Pop(); got != want {
+					t.Fatalf("pop returned class %s, want class %s", got.Class, want.Class)
+				}
+			}
+		})
+	}
+}
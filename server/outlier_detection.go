@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gookit/ini/v2"
+)
+
+// outcome of a request/connection attempt sent to a server, observed from live traffic.
+type Outcome int
+
+const (
+	Success           Outcome = iota
+	ServerError               // server responded with a 5xx status code.
+	ConnectionFailure         // connection refused, reset or timed out.
+	Ignored                   // failure not caused by the server, eg: user cancelled the request.
+)
+
+// keys used to configure outlier detection at section level.
+var outlierDetectionKeys = []string{
+	"outlier_detection",
+	"outlier_consecutive_failures",
+	"outlier_error_rate",
+	"outlier_window",
+	"outlier_min_requests",
+	"outlier_base_ejection_time",
+	"outlier_max_ejection_time",
+	"outlier_max_ejection_percent",
+}
+
+type OutlierDetectionConfig struct {
+	Enabled bool
+
+	ConsecutiveFailures int           // number of consecutive connection failures after which a server is ejected.
+	ErrorRate           int           // percentage of 5xx responses/connection failures in a window, after which a server is ejected.
+	Window              time.Duration // duration over which error rate is calculated.
+	MinRequests         int           // minimum number of requests in a window, before error rate is considered.
+
+	BaseEjectionTime   time.Duration // ejection time is BaseEjectionTime * 2^(number of times server was ejected - 1)
+	MaxEjectionTime    time.Duration
+	MaxEjectionPercent int // maximum percentage of servers in the pool that can be ejected at once.
+}
+
+func ConfigureOutlierDetection(section ini.Section, sectionName string) (OutlierDetectionConfig, error) {
+
+	var cfg OutlierDetectionConfig
+	var err error
+
+	if cfg.Enabled, err = parseSectionBoolConfig(section, "outlier_detection", sectionName, false); err != nil {
+		return cfg, err
+	}
+	if cfg.ConsecutiveFailures, err = parseSectionIntConfig(section, "outlier_consecutive_failures", sectionName, 5); err != nil {
+		return cfg, err
+	}
+	if cfg.ErrorRate, err = parseSectionIntConfig(section, "outlier_error_rate", sectionName, 50); err != nil {
+		return cfg, err
+	}
+	if cfg.MinRequests, err = parseSectionIntConfig(section, "outlier_min_requests", sectionName, 10); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxEjectionPercent, err = parseSectionIntConfig(section, "outlier_max_ejection_percent", sectionName, 50); err != nil {
+		return cfg, err
+	}
+
+	// durations are configured in milliseconds.
+	window, err := parseSectionIntConfig(section, "outlier_window", sectionName, 10000)
+	if err != nil {
+		return cfg, err
+	}
+	baseEjectionTime, err := parseSectionIntConfig(section, "outlier_base_ejection_time", sectionName, 30000)
+	if err != nil {
+		return cfg, err
+	}
+	maxEjectionTime, err := parseSectionIntConfig(section, "outlier_max_ejection_time", sectionName, 300000)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.ErrorRate > 100 || cfg.MaxEjectionPercent > 100 {
+		return cfg, fmt.Errorf("invalid config, %s.outlier_error_rate and %s.outlier_max_ejection_percent should be percentages between 0 and 100", sectionName, sectionName)
+	}
+	if window == 0 || baseEjectionTime == 0 || maxEjectionTime < baseEjectionTime {
+		return cfg, fmt.Errorf("invalid config, %s.outlier_window and %s.outlier_base_ejection_time should be positive, and %s.outlier_max_ejection_time should be greater than base ejection time", sectionName, sectionName, sectionName)
+	}
+
+	cfg.Window = time.Duration(window) * time.Millisecond
+	cfg.BaseEjectionTime = time.Duration(baseEjectionTime) * time.Millisecond
+	cfg.MaxEjectionTime = time.Duration(maxEjectionTime) * time.Millisecond
+
+	return cfg, nil
+}
+
+// outlier detection state of a single server.
+type outlierStats struct {
+	consecutiveFailures int
+
+	windowStart    time.Time
+	windowRequests int
+	windowErrors   int
+
+	ejectionCount int // number of times the server was ejected recently, used to calculate ejection time.
+	ejected       bool
+	ejectedUntil  time.Time
+	returnedAt    time.Time // time at which the server last returned to the pool after being ejected.
+}
+
+/*
+OutlierDetector ejects servers from the pool based on failures observed in live traffic (passive health checking).
+A server is ejected when it has too many consecutive connection failures, or when its error rate over a window is too high.
+Ejected servers return after an ejection time, which increases exponentially each time the server is ejected.
+A single OutlierDetector is shared by all servers of a pool, so that the number of servers ejected at once can be capped.
+*/
+type OutlierDetector struct {
+	config  OutlierDetectionConfig
+	servers map[int]*outlierStats
+	mutex   *sync.Mutex
+	logger  *log.Logger
+}
+
+func InitializeOutlierDetector(cfg OutlierDetectionConfig, serverIds []int, loggerPrefix string) *OutlierDetector {
+
+	servers := make(map[int]*outlierStats, len(serverIds))
+	for _, serverId := range serverIds {
+		servers[serverId] = &outlierStats{windowStart: time.Now()}
+	}
+
+	return &OutlierDetector{
+		config:  cfg,
+		servers: servers,
+		mutex:   &sync.Mutex{},
+		logger:  log.New(os.Stdout, loggerPrefix, 0),
+	}
+}
+
+// must be called with mutex held. returns true if the server is currently ejected, and handles return of a server whose ejection time has passed.
+func (od *OutlierDetector) checkEjection(serverId int, stats *outlierStats, now time.Time) bool {
+
+	if !stats.ejected {
+		return false
+	}
+	if now.Before(stats.ejectedUntil) {
+		return true
+	}
+
+	stats.ejected = false
+	stats.returnedAt = now
+	stats.consecutiveFailures = 0
+	stats.windowStart = now
+	stats.windowRequests = 0
+	stats.windowErrors = 0
+	od.logger.Printf("server %d returned to the pool after ejection", serverId)
+	return false
+}
+
+// IsEjected returns true if the server has been ejected from the pool.
+func (od *OutlierDetector) IsEjected(serverId int) bool {
+
+	if od == nil || !od.config.Enabled {
+		return false
+	}
+
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	stats, ok := od.servers[serverId]
+	if !ok {
+		return false
+	}
+	return od.checkEjection(serverId, stats, time.Now())
+}
+
+// ReturnedAt returns the time at which the server last returned to the pool after being ejected, or the zero time if it was never ejected.
+func (od *OutlierDetector) ReturnedAt(serverId int) time.Time {
+
+	if od == nil || !od.config.Enabled {
+		return time.Time{}
+	}
+
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	stats, ok := od.servers[serverId]
+	if !ok {
+		return time.Time{}
+	}
+	od.checkEjection(serverId, stats, time.Now())
+	return stats.returnedAt
+}
+
+// must be called with mutex held.
+func (od *OutlierDetector) eject(serverId int, stats *outlierStats, now time.Time, reason string) {
+
+	ejectedCount := 0
+	for id, s := range od.servers {
+		if id != serverId && od.checkEjection(id, s, now) {
+			ejectedCount++
+		}
+	}
+
+	// at least one server can always be ejected.
+	if ejectedCount > 0 && (ejectedCount+1)*100 > od.config.MaxEjectionPercent*len(od.servers) {
+		od.logger.Printf("server %d not ejected (%s), maximum ejection percentage %d%% reached", serverId, reason, od.config.MaxEjectionPercent)
+		return
+	}
+
+	stats.ejectionCount++
+
+	ejectionTime := od.config.BaseEjectionTime
+	for i := 1; i < stats.ejectionCount && ejectionTime < od.config.MaxEjectionTime; i++ {
+		ejectionTime *= 2
+	}
+	if ejectionTime > od.config.MaxEjectionTime {
+		ejectionTime = od.config.MaxEjectionTime
+	}
+
+	stats.ejected = true
+	stats.ejectedUntil = now.Add(ejectionTime)
+	od.logger.Printf("server %d ejected for %s : %s", serverId, ejectionTime, reason)
+}
+
+// RecordOutcome records the outcome of a request/connection attempt sent to a server, and ejects the server if required.
+func (od *OutlierDetector) RecordOutcome(serverId int, outcome Outcome) {
+
+	if od == nil || !od.config.Enabled || outcome == Ignored {
+		return
+	}
+
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	stats, ok := od.servers[serverId]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+
+	// outcomes of requests sent before the server was ejected are ignored.
+	if od.checkEjection(serverId, stats, now) {
+		return
+	}
+
+	if now.Sub(stats.windowStart) > od.config.Window {
+		// a server that was not ejected for a whole window is gradually forgiven for previous ejections.
+		if stats.ejectionCount > 0 && now.After(stats.ejectedUntil.Add(od.config.Window)) {
+			stats.ejectionCount--
+		}
+		stats.windowStart = now
+		stats.windowRequests = 0
+		stats.windowErrors = 0
+	}
+
+	stats.windowRequests++
+
+	switch outcome {
+
+	case Success:
+		stats.consecutiveFailures = 0
+
+	case ServerError:
+		stats.windowErrors++
+
+	case ConnectionFailure:
+		stats.windowErrors++
+		stats.consecutiveFailures++
+
+		if od.config.ConsecutiveFailures > 0 && stats.consecutiveFailures >= od.config.ConsecutiveFailures {
+			od.eject(serverId, stats, now, fmt.Sprintf("%d consecutive connection failures", stats.consecutiveFailures))
+			return
+		}
+	}
+
+	if stats.windowRequests >= od.config.MinRequests && stats.windowErrors*100 >= od.config.ErrorRate*stats.windowRequests && od.config.ErrorRate > 0 {
+		od.eject(serverId, stats, now, fmt.Sprintf("%d of %d requests failed in the last %s", stats.windowErrors, stats.windowRequests, od.config.Window))
+	}
+}
+
+/*
+ClassifyError returns the outcome of a request/connection attempt that failed with err.
+Errors caused by the user cancelling the request are ignored, every other error (connection refused, reset, timeout) is treated as a connection failure.
+*/
+func ClassifyError(err error) Outcome {
+
+	if err == nil {
+		return Success
+	}
+	if errors.Is(err, context.Canceled) {
+		return Ignored
+	}
+	return ConnectionFailure
+}
+
+// ClassifyStatus returns the outcome of a request that received a response with status code.
+func ClassifyStatus(status int) Outcome {
+
+	if status >= 500 {
+		return ServerError
+	}
+	return Success
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/metrics"
+	"github.com/gookit/ini/v2"
+)
+
+// keys used to configure the retry policy at section level.
+var retryPolicyKeys = []string{
+	"retry_max_attempts",
+	"retry_on_status",
+	"retry_methods",
+	"retry_per_try_timeout",
+	"retry_max_body_size",
+	"retry_budget_percent",
+	"retry_budget_min_retries",
+}
+
+// returned by a worker when the server does not send response headers within the response header timeout (or per try timeout).
+var ErrResponseHeaderTimeout = errors.New("response header timeout exceeded")
+
+// duration over which the retry budget is calculated.
+const retryBudgetWindow = 10 * time.Second
+
+/*
+RetryPolicy decides wether a failed request is sent again to a different server.
+Only requests with idempotent methods, or with an Idempotency-Key header, are retried.
+*/
+type RetryPolicy struct {
+	MaxAttempts   int          // maximum number of times a request is sent to a server, including the first attempt.
+	RetryOnStatus map[int]bool // status codes of responses that are retried. connection failures are always retried.
+	Methods       map[string]bool
+	PerTryTimeout time.Duration // maximum time to wait for the response headers of a single attempt. 0 disables the timeout.
+	MaxBodySize   int64         // requests with larger bodies are not retried, as their body cannot be buffered for replay.
+
+	Budget *RetryBudget
+}
+
+func ConfigureRetryPolicy(section ini.Section, sectionName string) (RetryPolicy, error) {
+
+	var policy RetryPolicy
+	var err error
+
+	if policy.MaxAttempts, err = parseSectionIntConfig(section, "retry_max_attempts", sectionName, 1); err != nil {
+		return policy, err
+	}
+	if policy.MaxAttempts == 0 {
+		return policy, fmt.Errorf("invalid config, %s.retry_max_attempts should be a positive integer", sectionName)
+	}
+
+	perTryTimeout, err := parseSectionIntConfig(section, "retry_per_try_timeout", sectionName, 0)
+	if err != nil {
+		return policy, err
+	}
+	policy.PerTryTimeout = time.Duration(perTryTimeout) * time.Millisecond
+
+	maxBodySize, err := parseSectionIntConfig(section, "retry_max_body_size", sectionName, 64*1024)
+	if err != nil {
+		return policy, err
+	}
+	policy.MaxBodySize = int64(maxBodySize)
+
+	budgetPercent, err := parseSectionIntConfig(section, "retry_budget_percent", sectionName, 20)
+	if err != nil {
+		return policy, err
+	}
+	budgetMinRetries, err := parseSectionIntConfig(section, "retry_budget_min_retries", sectionName, 10)
+	if err != nil {
+		return policy, err
+	}
+	policy.Budget = InitializeRetryBudget(budgetPercent, budgetMinRetries)
+
+	retryOnStatus := "502,503,504"
+	if val, ok := section["retry_on_status"]; ok {
+		retryOnStatus = val
+	}
+
+	policy.RetryOnStatus = make(map[int]bool)
+	for _, field := range strings.Split(retryOnStatus, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		status, err := strconv.Atoi(field)
+		if err != nil || status < 100 || status > 599 {
+			return policy, fmt.Errorf("invalid config, %s.retry_on_status should be a comma separated list of status codes, eg: 502,503,504", sectionName)
+		}
+		policy.RetryOnStatus[status] = true
+	}
+
+	methods := "GET,HEAD,OPTIONS,PUT,DELETE,TRACE"
+	if val := section["retry_methods"]; val != "" {
+		methods = val
+	}
+
+	policy.Methods = make(map[string]bool)
+	for _, method := range strings.Split(methods, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			policy.Methods[method] = true
+		}
+	}
+
+	return policy, nil
+}
+
+// Enabled returns true if requests can be sent to a server more than once.
+func (policy RetryPolicy) Enabled() bool {
+
+	return policy.MaxAttempts > 1
+}
+
+// IsRetryable returns true if the request is safe to retry, ie: its method is idempotent, or it has an Idempotency-Key header.
+func (policy RetryPolicy) IsRetryable(r *http.Request) bool {
+
+	return policy.Methods[r.Method] || r.Header.Get("Idempotency-Key") != ""
+}
+
+/*
+ShouldRetry returns true if the result of an attempt is a failure that should be retried.
+Connection failures (including connect timeouts) and response header timeouts are retried, along with responses with a status code in RetryOnStatus.
+Attempts cancelled by the user are never retried. Attempt errors cannot tell the request timeout apart from a connect timeout,
+as both match context.DeadlineExceeded, so callers must check the context of the request before retrying.
+*/
+func (policy RetryPolicy) ShouldRetry(result JobResult) bool {
+
+	if result.Err != nil {
+		return !errors.Is(result.Err, context.Canceled)
+	}
+	return policy.RetryOnStatus[result.Response.StatusCode]
+}
+
+/*
+RetryBudget limits the number of retries to a percentage of the number of requests, so that retries do not amplify an outage.
+A minimum number of retries is always allowed, so that retries are possible when traffic is low.
+*/
+type RetryBudget struct {
+	percent    int
+	minRetries int
+
+	windowStart    time.Time
+	windowRequests int
+	windowRetries  int
+
+	mutex *sync.Mutex
+}
+
+func InitializeRetryBudget(percent int, minRetries int) *RetryBudget {
+
+	return &RetryBudget{
+		percent:     percent,
+		minRetries:  minRetries,
+		windowStart: time.Now(),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// must be called with mutex held.
+func (rb *RetryBudget) refresh(now time.Time) {
+
+	if now.Sub(rb.windowStart) > retryBudgetWindow {
+		rb.windowStart = now
+		rb.windowRequests = 0
+		rb.windowRetries = 0
+	}
+}
+
+// RecordRequest records a request received by the proxy, increasing the number of retries allowed.
+func (rb *RetryBudget) RecordRequest() {
+
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	rb.refresh(time.Now())
+	rb.windowRequests++
+}
+
+// AcquireRetry returns true if the budget allows one more retry, and records it.
+func (rb *RetryBudget) AcquireRetry() bool {
+
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	rb.refresh(time.Now())
+
+	allowed := max(rb.minRetries, rb.windowRequests*rb.percent/100)
+
+	if rb.windowRetries >= allowed {
+		metrics.AddCounter("proxy_http_retry_budget_exhausted_total", "number of retries not attempted because the retry budget was exhausted.", nil, 1)
+		return false
+	}
+	rb.windowRetries++
+	return true
+}
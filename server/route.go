@@ -0,0 +1,236 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gookit/ini/v2"
+)
+
+// keys used to configure timeouts of requests sent to servers, at section level and for a single route.
+var timeoutKeys = []string{"connect_timeout", "response_header_timeout", "request_timeout"}
+
+// keys used to configure a single route in the [http] section, of the form route{number}_{config_name}.
+var routeKeys = append([]string{"prefix", "hedge_delay", "hedge_percentile", "priority"}, timeoutKeys...)
+
+const (
+	// number of recent latencies of a route used to calculate the hedge delay.
+	latencySamples = 1000
+	// minimum number of latencies recorded before the hedge delay is calculated using a percentile.
+	minLatencySamples = 20
+	// duration for which a calculated percentile is reused.
+	percentileRefreshInterval = time.Second
+)
+
+/*
+Route contains configs that apply to requests whose path starts with Prefix.
+If more than one route matches a request, the route with the longest prefix is used.
+*/
+type Route struct {
+	RouteId int
+	Prefix  string
+
+	HedgeDelay      time.Duration // a hedged request is sent to another server if no response is received within HedgeDelay. 0 disables hedging.
+	HedgePercentile int           // if not 0, HedgeDelay is replaced by this percentile of the recent latencies of the route.
+
+	Timeouts Timeouts
+	Priority string // priority class of requests matching the route, when they are queued.
+
+	Latency *LatencyTracker
+}
+
+// Timeouts of requests sent to servers. A timeout of 0 is disabled.
+type Timeouts struct {
+	Connect        time.Duration // maximum time to establish a connection to the server.
+	ResponseHeader time.Duration // maximum time to wait for response headers, after the request has been sent to a worker.
+	Request        time.Duration // maximum time for the whole request, including retries and streaming of the response body.
+}
+
+/*
+ConfigureTimeouts overrides the timeouts in base with the timeouts present in config, in milliseconds.
+keyPrefix is used in error messages, eg: "http." or "route1_".
+*/
+func ConfigureTimeouts(config map[string]string, base Timeouts, keyPrefix string) (Timeouts, error) {
+
+	timeouts := base
+
+	for _, timeout := range []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"connect_timeout", &timeouts.Connect},
+		{"response_header_timeout", &timeouts.ResponseHeader},
+		{"request_timeout", &timeouts.Request},
+	} {
+		val, ok := config[timeout.key]
+		if !ok || val == "" {
+			continue
+		}
+		ms, err := strconv.Atoi(val)
+		if err != nil || ms < 0 {
+			return timeouts, fmt.Errorf("invalid config, %s%s should be a valid non negative integer (milliseconds)", keyPrefix, timeout.key)
+		}
+		*timeout.value = time.Duration(ms) * time.Millisecond
+	}
+
+	return timeouts, nil
+}
+
+// ConfigureRoutes configures the routes of the [http] section. Timeouts of a route default to the section level timeouts.
+func ConfigureRoutes(httpSection ini.Section, sectionTimeouts Timeouts) ([]Route, error) {
+
+	routeConfigs, routeIds, err := groupNumberedKeys(httpSection, "http", "route", httpSectionKeys, "server")
+
+	if err != nil {
+		return nil, fmt.Errorf("%s\n\nformat for routes:\n\n[http]\nroute{number}_prefix={path prefix}\nroute{number}_{config_name}={config}", err.Error())
+	}
+
+	routes := make([]Route, 0, len(routeIds))
+
+	for _, routeId := range routeIds {
+
+		config := routeConfigs[routeId]
+
+		for configName := range config {
+			if !containsKey(configName, routeKeys) {
+				return nil, fmt.Errorf("invalid config, unknown key route%d_%s", routeId, configName)
+			}
+		}
+
+		route := Route{RouteId: routeId, Prefix: config["prefix"], Latency: InitializeLatencyTracker()}
+
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return nil, fmt.Errorf("invalid config, route%d_prefix should start with /", routeId)
+		}
+
+		hedgeDelay, err := parseNumberedIntConfig(config, "route", "hedge_delay", routeId, 0)
+		if err != nil {
+			return nil, err
+		}
+		route.HedgeDelay = time.Duration(hedgeDelay) * time.Millisecond
+
+		if route.HedgePercentile, err = parseNumberedIntConfig(config, "route", "hedge_percentile", routeId, 0); err != nil {
+			return nil, err
+		}
+		if route.HedgePercentile > 99 {
+			return nil, fmt.Errorf("invalid config, route%d_hedge_percentile should be between 1 and 99", routeId)
+		}
+
+		route.Priority = PriorityNormal
+		if val := config["priority"]; val != "" {
+			var ok bool
+			if route.Priority, ok = ParsePriority(val); !ok {
+				return nil, fmt.Errorf("invalid config, route%d_priority should be high/normal/low", routeId)
+			}
+		}
+
+		if route.Timeouts, err = ConfigureTimeouts(config, sectionTimeouts, fmt.Sprintf("route%d_", routeId)); err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// MatchRoute returns the route with the longest prefix matching path, or nil if no route matches.
+func MatchRoute(routes []Route, path string) *Route {
+
+	var matched *Route
+
+	for index := range routes {
+		if strings.HasPrefix(path, routes[index].Prefix) && (matched == nil || len(routes[index].Prefix) > len(matched.Prefix)) {
+			matched = &routes[index]
+		}
+	}
+	return matched
+}
+
+// HedgingEnabled returns true if requests matching the route can be hedged.
+func (route *Route) HedgingEnabled() bool {
+
+	return route != nil && (route.HedgeDelay > 0 || route.HedgePercentile > 0)
+}
+
+/*
+GetHedgeDelay returns the duration after which a hedged request is sent.
+If a percentile is configured, it is used once enough latencies have been recorded, with HedgeDelay being used until then.
+Returns false if no delay is available yet.
+*/
+func (route *Route) GetHedgeDelay() (time.Duration, bool) {
+
+	if route.HedgePercentile > 0 {
+		if delay, ok := route.Latency.Percentile(route.HedgePercentile); ok {
+			return delay, true
+		}
+	}
+	return route.HedgeDelay, route.HedgeDelay > 0
+}
+
+// LatencyTracker records the most recent latencies of a route, and calculates percentiles over them.
+type LatencyTracker struct {
+	samples []time.Duration
+	next    int // index at which the next latency is recorded, once samples is full.
+
+	cachedPercentiles map[int]time.Duration
+	cachedAt          time.Time
+
+	mutex *sync.Mutex
+}
+
+func InitializeLatencyTracker() *LatencyTracker {
+
+	return &LatencyTracker{
+		samples:           make([]time.Duration, 0, latencySamples),
+		cachedPercentiles: make(map[int]time.Duration),
+		mutex:             &sync.Mutex{},
+	}
+}
+
+func (lt *LatencyTracker) Record(latency time.Duration) {
+
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	if len(lt.samples) < latencySamples {
+		lt.samples = append(lt.samples, latency)
+		return
+	}
+	lt.samples[lt.next] = latency
+	lt.next = (lt.next + 1) % latencySamples
+}
+
+// Percentile returns the p-th percentile of the recorded latencies, or false if not enough latencies have been recorded.
+func (lt *LatencyTracker) Percentile(p int) (time.Duration, bool) {
+
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	if len(lt.samples) < minLatencySamples {
+		return 0, false
+	}
+
+	if time.Since(lt.cachedAt) > percentileRefreshInterval {
+		lt.cachedPercentiles = make(map[int]time.Duration)
+		lt.cachedAt = time.Now()
+	}
+
+	if percentile, ok := lt.cachedPercentiles[p]; ok {
+		return percentile, true
+	}
+
+	sorted := slices.Clone(lt.samples)
+	slices.Sort(sorted)
+
+	index := int(math.Ceil(float64(p)/100*float64(len(sorted)))) - 1
+	percentile := sorted[max(index, 0)]
+
+	lt.cachedPercentiles[p] = percentile
+	return percentile, true
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/util"
+	"github.com/gookit/ini/v2"
+)
+
+// keys used to configure draining of websocket sessions at section level.
+var sessionDrainKeys = []string{"session_drain", "session_drain_grace_period", "session_drain_spread", "session_drain_close_code"}
+
+type SessionDrainConfig struct {
+	Enabled     bool          // if true, sessions of a server are closed once it becomes unhealthy or draining.
+	GracePeriod time.Duration // time given to the server to recover before its sessions are closed.
+	Spread      time.Duration // duration over which the closes are spread, so that users do not reconnect to the remaining servers all at once. 0 closes every session at once.
+	CloseCode   int           // close code sent to both sides of a drained session.
+}
+
+func ConfigureSessionDrain(section ini.Section, sectionName string) (SessionDrainConfig, error) {
+
+	cfg := SessionDrainConfig{}
+	var err error
+
+	if cfg.Enabled, err = parseSectionBoolConfig(section, "session_drain", sectionName, false); err != nil {
+		return cfg, err
+	}
+
+	gracePeriod, err := parseSectionIntConfig(section, "session_drain_grace_period", sectionName, 10000)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.GracePeriod = time.Duration(gracePeriod) * time.Millisecond
+
+	spread, err := parseSectionIntConfig(section, "session_drain_spread", sectionName, 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Spread = time.Duration(spread) * time.Millisecond
+
+	if cfg.CloseCode, err = ParseCloseCode(section, "session_drain_close_code", sectionName); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+/*
+ParseCloseCode parses a close code sent by the proxy when it closes websocket sessions, 1001 (going away) is used by default.
+Only codes that tell users the connection can be attempted again are accepted: 1000, 1001, 1011, 1012, 1013, or a code between 3000 and 4999.
+*/
+func ParseCloseCode(section ini.Section, key string, sectionName string) (int, error) {
+
+	code, err := parseSectionIntConfig(section, key, sectionName, 1001)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case code == 1000, code == 1001, code >= 1011 && code <= 1013, code >= 3000 && code <= 4999:
+		return code, nil
+	default:
+		return 0, fmt.Errorf("invalid config, %s.%s should be 1000, 1001, 1011, 1012, 1013 or between 3000 and 4999", sectionName, key)
+	}
+}
+
+// SessionRegistry contains the open websocket relay sessions of a server.
+type SessionRegistry struct {
+	sessions map[*util.RelaySession]bool
+	draining bool // true while the sessions of the server are being drained.
+	mutex    *sync.Mutex
+}
+
+func InitializeSessionRegistry() *SessionRegistry {
+
+	return &SessionRegistry{sessions: make(map[*util.RelaySession]bool), mutex: &sync.Mutex{}}
+}
+
+func (sr *SessionRegistry) Add(session *util.RelaySession) {
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.sessions[session] = true
+}
+
+func (sr *SessionRegistry) Remove(session *util.RelaySession) {
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	delete(sr.sessions, session)
+}
+
+// List returns the sessions open when it is called.
+func (sr *SessionRegistry) List() []*util.RelaySession {
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	sessions := make([]*util.RelaySession, 0, len(sr.sessions))
+	for session := range sr.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// returns false if the sessions are already being drained.
+func (sr *SessionRegistry) startDrain() bool {
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	if sr.draining {
+		return false
+	}
+	sr.draining = true
+	return true
+}
+
+func (sr *SessionRegistry) stopDrain() {
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.draining = false
+}
+
+/*
+DrainSessions closes the open sessions of the server after it becomes unhealthy or draining.
+The server is given the grace period to recover, after which its sessions are closed with the configured close code,
+spread evenly over cfg.Spread. Draining stops if the server becomes healthy again.
+Does nothing if the sessions of the server are already being drained.
+*/
+func (ws *WebsocketServer) DrainSessions(cfg SessionDrainConfig) {
+
+	if !ws.Sessions.startDrain() {
+		return
+	}
+	defer ws.Sessions.stopDrain()
+
+	time.Sleep(cfg.GracePeriod)
+
+	status := ws.Health.Status()
+	if status == Healthy {
+		ws.Logger.Println("server recovered within the session drain grace period, sessions are not closed")
+		return
+	}
+
+	sessions := ws.Sessions.List()
+	if len(sessions) == 0 {
+		return
+	}
+
+	interval := cfg.Spread / time.Duration(len(sessions))
+	ws.Logger.Printf("server is %s, closing %d websocket sessions over %s", status, len(sessions), cfg.Spread)
+
+	for index, session := range sessions {
+
+		if ws.Health.Status() == Healthy {
+			ws.Logger.Printf("server recovered, %d websocket sessions are not closed", len(sessions)-index)
+			return
+		}
+		session.Close(cfg.CloseCode, "server "+status, "server_"+status)
+
+		if index < len(sessions)-1 {
+			time.Sleep(interval)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gookit/ini/v2"
+)
+
+// keys used to configure slow start at section level.
+var slowStartKeys = []string{"slow_start", "slow_start_aggression", "slow_start_min_weight"}
+
+type SlowStartConfig struct {
+	Duration         time.Duration // duration over which the weight of a recovered server is increased to its full weight. 0 disables slow start. Newly added servers are not slow started.
+	Aggression       float64       // weight is increased by (elapsed time / Duration) ^ (1 / Aggression). 1 increases weight linearly.
+	MinWeightPercent int           // percentage of its full weight received by a server as soon as it recovers.
+}
+
+func ConfigureSlowStart(section ini.Section, sectionName string) (SlowStartConfig, error) {
+
+	cfg := SlowStartConfig{Aggression: 1}
+
+	duration, err := parseSectionIntConfig(section, "slow_start", sectionName, 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Duration = time.Duration(duration) * time.Millisecond
+
+	if cfg.MinWeightPercent, err = parseSectionIntConfig(section, "slow_start_min_weight", sectionName, 10); err != nil {
+		return cfg, err
+	}
+	if cfg.MinWeightPercent == 0 || cfg.MinWeightPercent > 100 {
+		return cfg, fmt.Errorf("invalid config, %s.slow_start_min_weight should be a percentage between 1 and 100", sectionName)
+	}
+
+	if val := section["slow_start_aggression"]; val != "" {
+		cfg.Aggression, err = strconv.ParseFloat(val, 64)
+		if err != nil || cfg.Aggression <= 0 {
+			return cfg, fmt.Errorf("invalid config, %s.slow_start_aggression should be a positive number", sectionName)
+		}
+	}
+
+	return cfg, nil
+}
+
+/*
+Factor returns the fraction of its full weight that a server receives, if it recovered at recoveredAt.
+Returns 1 if slow start is disabled, or the server did not recover recently.
+*/
+func (cfg SlowStartConfig) Factor(recoveredAt time.Time, now time.Time) float64 {
+
+	if cfg.Duration == 0 || recoveredAt.IsZero() {
+		return 1
+	}
+
+	elapsed := now.Sub(recoveredAt)
+
+	if elapsed >= cfg.Duration {
+		return 1
+	}
+
+	factor := math.Pow(float64(elapsed)/float64(cfg.Duration), 1/cfg.Aggression)
+	return math.Max(factor, float64(cfg.MinWeightPercent)/100)
+}
+
+/*
+recoveredAt returns the time at which a server last became healthy after being unhealthy/draining, or returned to the pool after being ejected, whichever is later.
+Servers which became healthy after their first health check are not considered to have recovered, as every server starts receiving traffic at the same time.
+Servers are only added when the proxy starts, as the config file is read at startup, so newly added servers are not slow started either.
+*/
+func recoveredAt(health *HealthState, outlierDetector *OutlierDetector, serverId int) time.Time {
+
+	var recovered time.Time
+
+	if transition, ok := health.LastTransition(); ok && transition.To == Healthy && transition.From != Starting {
+		recovered = transition.Time
+	}
+
+	if returned := outlierDetector.ReturnedAt(serverId); returned.After(recovered) {
+		recovered = returned
+	}
+	return recovered
+}
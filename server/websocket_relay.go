@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/util"
+	"github.com/gookit/ini/v2"
+)
+
+// keys used to configure the handshake and relay of websocket connections between users and servers at section level.
+var websocketRelayKeys = []string{
+	"ping_mode",
+	"keepalive_interval",
+	"keepalive_timeout",
+	"idle_timeout",
+	"max_lifetime",
+	"handshake_headers",
+	"allowed_origins",
+	"handshake_timeout",
+	"connect_max_attempts",
+}
+
+// WebsocketDialConfig contains the configuration of websocket connections established with servers.
+type WebsocketDialConfig struct {
+	HandshakeTimeout time.Duration // maximum time to connect to the server and complete the handshake. 0 disables the timeout.
+	MaxAttempts      int           // maximum number of servers a connection is attempted with, if connecting to the server fails.
+}
+
+func ConfigureWebsocketDial(section ini.Section, sectionName string) (WebsocketDialConfig, error) {
+
+	cfg := WebsocketDialConfig{}
+
+	handshakeTimeout, err := parseSectionIntConfig(section, "handshake_timeout", sectionName, 45000)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.HandshakeTimeout = time.Duration(handshakeTimeout) * time.Millisecond
+
+	if cfg.MaxAttempts, err = parseSectionIntConfig(section, "connect_max_attempts", sectionName, 3); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxAttempts == 0 {
+		return cfg, fmt.Errorf("invalid config, %s.connect_max_attempts should be a positive integer", sectionName)
+	}
+
+	return cfg, nil
+}
+
+func ConfigureWebsocketRelay(section ini.Section, sectionName string) (util.RelayConfig, error) {
+
+	cfg := util.RelayConfig{}
+
+	switch pingMode := strings.ToLower(section["ping_mode"]); pingMode {
+	case "", util.PingRelay:
+		cfg.PingMode = util.PingRelay
+	case util.PingAnswer:
+		cfg.PingMode = util.PingAnswer
+	default:
+		return cfg, fmt.Errorf("invalid config, %s.ping_mode should be relay/answer", sectionName)
+	}
+
+	// durations are configured in milliseconds.
+	for _, duration := range []struct {
+		key          string
+		value        *time.Duration
+		defaultValue int
+	}{
+		{"keepalive_interval", &cfg.KeepaliveInterval, 30000},
+		{"keepalive_timeout", &cfg.KeepaliveTimeout, 10000},
+		{"idle_timeout", &cfg.IdleTimeout, 0},
+		{"max_lifetime", &cfg.MaxLifetime, 0},
+	} {
+		ms, err := parseSectionIntConfig(section, duration.key, sectionName, duration.defaultValue)
+		if err != nil {
+			return cfg, err
+		}
+		*duration.value = time.Duration(ms) * time.Millisecond
+	}
+
+	if cfg.KeepaliveInterval > 0 && cfg.KeepaliveTimeout == 0 {
+		return cfg, fmt.Errorf("invalid config, %s.keepalive_timeout should be a positive integer when keepalive is enabled", sectionName)
+	}
+
+	return cfg, nil
+}
+
+// ConfigureHandshakeHeaders returns the policy deciding which headers of the user's handshake request are sent to the server. All headers are sent by default.
+func ConfigureHandshakeHeaders(section ini.Section) util.HandshakeHeaderPolicy {
+
+	return util.ParseHandshakeHeaderPolicy(section["handshake_headers"])
+}
+
+// ConfigureAllowedOrigins returns the policy deciding which origins users can open websocket connections from. Only same origin requests are accepted by default.
+func ConfigureAllowedOrigins(section ini.Section, sectionName string) (util.OriginPolicy, error) {
+
+	policy, ok := util.ParseOriginPolicy(section["allowed_origins"])
+	if !ok {
+		return policy, fmt.Errorf("invalid config, %s.allowed_origins should be * or a comma separated list of origins, eg: https://app.example.com,https://admin.example.com", sectionName)
+	}
+	return policy, nil
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gookit/ini/v2"
 )
@@ -12,34 +15,164 @@ import (
 type WebsocketServer struct {
 	ServerId int
 	Addr     string
+	Name     string // identifies the server in affinity cookies, shared with the http server of the same backend. Defaults to Addr.
 	Logger   *log.Logger
+
+	Weight    int             // share of connections received by the server, relative to other servers. Servers with weight 0 do not receive connections.
+	SlowStart SlowStartConfig // weight of the server is increased gradually after it recovers.
+
+	HealthCheck HealthCheckConfig
+	Health      *HealthState
+
+	OutlierDetector *OutlierDetector // shared by all servers of the pool, ejects servers based on failures observed in live traffic.
+
+	NumConns     *int // number of open websocket connections to the server.
+	NumConnMutex *sync.Mutex
+
+	Sessions *SessionRegistry // open relay sessions of the server, closed when the server is drained.
+}
+
+// section level keys of the [websocket] section, which do not configure a single server.
+var websocketSectionKeys = concatKeys([]string{"algorithm", "enable_health_check", "health_check_interval", "hash_key", "hash_bounded_load"}, healthCheckKeys, outlierDetectionKeys, slowStartKeys, websocketRelayKeys, sessionDrainKeys)
+
+// keys used to configure a single server in the [websocket] section, of the form server{number}_{config_name}. address and weight of the server are configured using server{number}.
+var websocketServerKeys = append([]string{"", "name"}, healthCheckKeys...)
+
+// format of the [websocket] section, shown when it is invalid.
+const websocketSectionFormat = "format for websocket section:\n\n[websocket]\nserver{number}={Host:Port} [weight={weight}]\nserver{number}_{config_name}={config}"
+
+/*
+parseWebsocketServerEntry parses the value of server{number}, of the form {host:port} followed by an optional weight suffix, eg: 10.0.0.1:8080 weight=3.
+Servers without a weight suffix have weight 1.
+*/
+func parseWebsocketServerEntry(val string, serverId int) (string, int, error) {
+
+	fields := strings.Fields(val)
+
+	if len(fields) == 0 {
+		return "", 0, fmt.Errorf("invalid config, value of server%d cannot be empty", serverId)
+	}
+
+	weight := 1 // default weight
+
+	for _, field := range fields[1:] {
+		weightString, found := strings.CutPrefix(field, "weight=")
+		w, err := strconv.Atoi(weightString)
+		if !found || err != nil || w < 0 {
+			return "", 0, fmt.Errorf("invalid config, server%d should be of the form {Host:Port} [weight={non negative integer}]\n\n%s", serverId, websocketSectionFormat)
+		}
+		weight = w
+	}
+
+	return fields[0], weight, nil
 }
 
-func InitializeWebsocketServer(serverAddr string, serverId int) WebsocketServer {
+func InitializeWebsocketServer(serverAddr string, serverName string, serverId int, weight int, slowStart SlowStartConfig, healthCheck HealthCheckConfig, outlierDetector *OutlierDetector) WebsocketServer {
 
+	numConns := 0
 	return WebsocketServer{
-		Addr:     serverAddr,
-		ServerId: serverId,
-		Logger:   log.New(os.Stdout, fmt.Sprintf("WEBSOCKET SERVER %d :     ", serverId), 0),
+		Addr:            serverAddr,
+		Name:            serverName,
+		ServerId:        serverId,
+		Logger:          log.New(os.Stdout, fmt.Sprintf("WEBSOCKET SERVER %d :     ", serverId), 0),
+		Weight:          weight,
+		SlowStart:       slowStart,
+		HealthCheck:     healthCheck,
+		Health:          InitializeHealthState(healthCheck.Rise, healthCheck.Fall),
+		OutlierDetector: outlierDetector,
+		NumConns:        &numConns,
+		NumConnMutex:    &sync.Mutex{},
+		Sessions:        InitializeSessionRegistry(),
 	}
 }
 
+// IsAvailable returns false if the server has been temporarily taken out of the pool, based on failures observed in live traffic.
+func (ws *WebsocketServer) IsAvailable() bool {
+
+	return !ws.OutlierDetector.IsEjected(ws.ServerId)
+}
+
+// SlowStartFactor returns the fraction of its full weight that the server currently receives, which is less than 1 while the server is in slow start.
+func (ws *WebsocketServer) SlowStartFactor() float64 {
+
+	return ws.SlowStart.Factor(recoveredAt(ws.Health, ws.OutlierDetector, ws.ServerId), time.Now())
+}
+
+func (ws *WebsocketServer) IncrementNumConns() {
+
+	ws.NumConnMutex.Lock()
+	*ws.NumConns++
+	ws.NumConnMutex.Unlock()
+}
+
+func (ws *WebsocketServer) DecrementNumConns() {
+
+	ws.NumConnMutex.Lock()
+	*ws.NumConns--
+	ws.NumConnMutex.Unlock()
+}
+
+func (ws *WebsocketServer) GetNumConns() int {
+
+	ws.NumConnMutex.Lock()
+	defer ws.NumConnMutex.Unlock()
+	return *ws.NumConns
+}
+
 func ConfigureWebsocketServers(websocketSection ini.Section) ([]WebsocketServer, error) {
 
 	wsServerPool := make([]WebsocketServer, 0)
-	serverId := 1
 
-	for key, srvAddr := range websocketSection {
+	sectionHealthCheck, err := ConfigureHealthCheck(websocketSection, DefaultHealthCheckConfig(), "websocket.")
+
+	if err != nil {
+		return nil, err
+	}
+
+	serverConfigs, serverIds, err := groupNumberedKeys(websocketSection, "websocket", "server", websocketSectionKeys)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s\n\n%s", err.Error(), websocketSectionFormat)
+	}
+
+	outlierDetectionConfig, err := ConfigureOutlierDetection(websocketSection, "websocket")
 
-		if key == "algorithm" || key == "enable_health_check" || key == "health_check_interval" {
-			continue
+	if err != nil {
+		return nil, err
+	}
+
+	outlierDetector := InitializeOutlierDetector(outlierDetectionConfig, serverIds, "WEBSOCKET OUTLIER DETECTOR : ")
+
+	slowStart, err := ConfigureSlowStart(websocketSection, "websocket")
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, serverId := range serverIds {
+
+		config := serverConfigs[serverId]
+
+		srvAddr, weight, err := parseWebsocketServerEntry(config[""], serverId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for configName := range config {
+			if !containsKey(configName, websocketServerKeys) {
+				return nil, fmt.Errorf("invalid config, unknown key server%d_%s", serverId, configName)
+			}
 		}
-		if !strings.HasPrefix(key, "server") {
-			return nil, fmt.Errorf("format for websocket section:\n\n[websocket]\nserver{number}={Host:Port}")
+
+		healthCheck, err := ConfigureHealthCheck(config, sectionHealthCheck, fmt.Sprintf("server%d_", serverId))
+
+		if err != nil {
+			return nil, err
 		}
 
-		wsServerPool = append(wsServerPool, InitializeWebsocketServer(srvAddr, serverId))
-		serverId++
+		log.Printf("Websocket server %d configured with addr : %s weight : %d", serverId, srvAddr, weight)
+		wsServerPool = append(wsServerPool, InitializeWebsocketServer(srvAddr, serverName(config, srvAddr), serverId, weight, slowStart, healthCheck, outlierDetector))
 	}
 
 	return wsServerPool, nil
@@ -1,5 +0,0 @@
-package types
-
-type HealthCheckResponse struct {
-	Status int `json:"status"`
-}
@@ -2,12 +2,18 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,9 +35,26 @@ type HandlerDialer struct {
 	Dialer net.Dialer
 }
 
-func (wd *WorkerDialer) Dial(network, address string) (net.Conn, error) {
+type connectTimeoutKey struct{}
 
-	conn, err := wd.Dialer.Dial(network, address)
+// WithConnectTimeout returns a copy of ctx, which limits the time taken by the worker's dialer to establish a connection to timeout. 0 disables the timeout.
+func WithConnectTimeout(ctx context.Context, timeout time.Duration) context.Context {
+
+	if timeout == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, connectTimeoutKey{}, timeout)
+}
+
+func (wd *WorkerDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+
+	if timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	conn, err := wd.Dialer.DialContext(ctx, network, address)
 
 	if err != nil {
 
@@ -51,8 +74,10 @@ func InitializeWorkerHTTPClient(logger *log.Logger, workerId int) http.Client {
 		WorkerId: workerId,
 	}
 
+	// compression is disabled so that the body and Content-Encoding header of the server's response are forwarded as is.
 	transport := &http.Transport{
-		Dial: dialer.Dial,
+		DialContext:        dialer.DialContext,
+		DisableCompression: true,
 	}
 
 	return http.Client{
@@ -81,8 +106,8 @@ func InitializeHandlerHTTPClient(logger *log.Logger) http.Client {
 		Dialer: net.Dialer{},
 	}
 
+	// timeout of each request is set by the caller.
 	return http.Client{
-		Timeout: 2 * time.Second,
 		Transport: &http.Transport{
 
 			Dial: dialer.Dial,
@@ -99,32 +124,92 @@ func MakeHttpHandlerFunc(f HTTPFunc) http.HandlerFunc {
 	}
 }
 
-func CopyRequest(r *http.Request, destinationAddr string) (*http.Request, error) {
+/*
+CopyRequest creates a copy of the request, to be sent to the server at destinationAddr.
+The path (including its original escaping) and query string are preserved.
+If preserveHost is true, the Host header sent by the user is passed through to the server, otherwise it is rewritten to destinationAddr.
+The body of the original request is not read into memory, it is streamed to the server as the new request is sent.
+*/
+func CopyRequest(r *http.Request, destinationAddr string, preserveHost bool) (*http.Request, error) {
+
+	newURL := url.URL{
+		Scheme:   "http",
+		Host:     destinationAddr,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("error while reading the body at handler %s", err.Error())
+	var body io.Reader
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		body = r.Body
 	}
-	r.Body.Close()
 
-	bodyReader := io.NopCloser(bytes.NewReader(body))
+	r2, err := http.NewRequest(r.Method, newURL.String(), body)
 
-	newURL := url.URL{Scheme: "http", Host: destinationAddr, Path: r.URL.Path}
+	if err != nil {
+		return nil, err
+	}
 
-	r2, err := http.NewRequest(r.Method, newURL.String(), bodyReader)
+	// -1 if length of body is unknown, in which case the body is sent using chunked transfer encoding.
+	if body != nil {
+		r2.ContentLength = r.ContentLength
+	}
 
 	for key, values := range r.Header {
 		// Copy each header value from the source to the destination
 		r2.Header[key] = append(r2.Header[key], values...)
 	}
+	RemoveHopByHopHeaders(r2.Header)
+
+	if preserveHost {
+		r2.Host = r.Host
+	}
 
-	return r2, err
+	return r2, nil
+}
+
+/*
+BufferRequestBody reads the body of the request into memory, so that it can be sent to a server more than once using r.GetBody.
+Bodies larger than maxSize are not buffered, in which case the bytes already read are put back in front of the rest of the body,
+and false is returned as the request cannot be replayed.
+*/
+func BufferRequestBody(r *http.Request, maxSize int64) (bool, error) {
+
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		r.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return true, nil
+	}
+
+	if r.ContentLength > maxSize {
+		return false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+
+	if err != nil {
+		return false, fmt.Errorf("error while reading request body : %w", err)
+	}
+
+	if int64(len(buf)) > maxSize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return false, nil
+	}
+
+	r.ContentLength = int64(len(buf))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(buf)), nil }
+	r.Body, _ = r.GetBody()
+
+	return true, nil
 }
 
 func WriteJSON(w http.ResponseWriter, status int, body any) {
 	//log.Println("called this function.")
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 
 	err := json.NewEncoder(w).Encode(body)
 	if err != nil {
@@ -132,22 +217,321 @@ func WriteJSON(w http.ResponseWriter, status int, body any) {
 	}
 }
 
-// used to write already json encoded messages to ResponseWriter
-func WriteResponse(w http.ResponseWriter, status int, body []byte) {
+// hop-by-hop headers, which are meaningful only for a single connection, and must not be forwarded by proxies.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
-	w.WriteHeader(status)
-	w.Header().Set("Content-Type", "application/json")
+// RemoveHopByHopHeaders removes hop-by-hop headers, along with any headers listed in the Connection header.
+func RemoveHopByHopHeaders(h http.Header) {
 
-	_, err := w.Write(body)
-	if err != nil {
-		log.Printf("error occured while writing to responseWriter %s", err.Error())
+	for _, value := range h.Values("Connection") {
+		for _, field := range strings.Split(value, ",") {
+			if field = textproto.TrimString(field); field != "" {
+				h.Del(field)
+			}
+		}
 	}
+
+	for _, key := range hopByHopHeaders {
+		h.Del(key)
+	}
+}
+
+/*
+CopyResponse writes the server's response to the ResponseWriter.
+Headers (excluding hop-by-hop headers), status code, body and trailers are forwarded, with the body being streamed.
+*/
+func CopyResponse(w http.ResponseWriter, resp *http.Response) error {
+
+	header := w.Header()
+
+	for key, values := range resp.Header {
+		header[key] = append(header[key], values...)
+	}
+	RemoveHopByHopHeaders(header)
+
+	// trailers known before the body is read are announced, so that they can be sent after the body.
+	announcedTrailers := make(map[string]bool, len(resp.Trailer))
+	for key := range resp.Trailer {
+		announcedTrailers[key] = true
+		header.Add("Trailer", key)
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	if err := StreamBody(w, resp.Body); err != nil {
+		return err
+	}
+
+	// resp.Trailer is populated once the body has been read completely, unannounced trailers are sent using TrailerPrefix.
+	for key, values := range resp.Trailer {
+		if !announcedTrailers[key] {
+			key = http.TrailerPrefix + key
+		}
+		header[key] = append(header[key], values...)
+	}
+
+	return nil
+}
+
+// size of the buffers used to stream response bodies from server to user.
+const streamBufferSize = 32 * 1024
+
+var streamBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, streamBufferSize)
+		return &b
+	},
+}
+
+/*
+StreamBody copies body to the ResponseWriter using a bounded buffer, instead of reading the whole body into memory.
+Each chunk is flushed as soon as it is written, so partial responses (eg: Server-Sent Events) reach the user immediately.
+*/
+func StreamBody(w http.ResponseWriter, body io.Reader) error {
+
+	bufPtr := streamBufferPool.Get().(*[]byte)
+	defer streamBufferPool.Put(bufPtr)
+	buf := *bufPtr
+
+	flusher, canFlush := w.(http.Flusher)
+
+	for {
+		n, readErr := body.Read(buf)
+
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return fmt.Errorf("error while writing to responseWriter : %w", err)
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return fmt.Errorf("error while reading response body : %w", readErr)
+		}
+	}
+}
+
+// headers used to pass information about the user to servers behind the proxy.
+var forwardingHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"Forwarded",
+	"Via",
 }
-func InitializeHeaders(r *http.Request) http.Header {
 
-	forwardHeader := make(http.Header, 1)
+/*
+InitializeHeaders returns the headers of the user's websocket handshake request that are sent to the server, according to policy.
+Forwarding headers are always sent. Hop-by-hop headers, and headers set by the websocket dialer (eg: Sec-WebSocket-Key), are never sent.
+*/
+func InitializeHeaders(r *http.Request, policy HandshakeHeaderPolicy) http.Header {
 
-	forwardHeader.Set("Auth", r.Header.Get("Auth"))
+	forwardHeader := make(http.Header, len(r.Header))
+
+	for key, values := range r.Header {
+		if policy.Allows(key) {
+			forwardHeader[key] = append([]string(nil), values...)
+		}
+	}
+
+	RemoveHopByHopHeaders(forwardHeader)
+	for _, key := range websocketHandshakeHeaders {
+		forwardHeader.Del(key)
+	}
+
+	for _, key := range forwardingHeaders {
+		if values := r.Header.Values(key); len(values) > 0 {
+			forwardHeader[key] = append([]string(nil), values...)
+		}
+	}
 	return forwardHeader
 
 }
+
+// ParseTrustedProxies parses a comma separated list of CIDRs (eg: 10.0.0.0/8) or IP addresses.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+
+	trustedProxies := make([]*net.IPNet, 0)
+
+	for _, entry := range strings.Split(list, ",") {
+
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %s", entry)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	return trustedProxies, nil
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientIPKey struct{}
+
+type trustedProxyKey struct{}
+
+/*
+ClientIP returns the IP address of the user that sent the request.
+Entries of X-Forwarded-For are checked from right to left, as entries added by trusted proxies are appended after the ones sent by the user,
+and the first entry that is not a trusted proxy is returned. If the request was not received from a trusted proxy, its remote address is returned.
+*/
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+
+	peerIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peerIP = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(net.ParseIP(peerIP), trustedProxies) {
+		return peerIP
+	}
+
+	var entries []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+
+	for index := len(entries) - 1; index >= 0; index-- {
+		entry := strings.TrimSpace(entries[index])
+		if entry != "" && !isTrustedProxy(net.ParseIP(entry), trustedProxies) {
+			return entry
+		}
+	}
+
+	// every entry was added by a trusted proxy, so the leftmost one is closest to the user.
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			return entry
+		}
+	}
+	return peerIP
+}
+
+/*
+WithClientIP returns a copy of the request, whose context contains the IP address of the user as returned by ClientIP,
+and whether the request was received from a trusted proxy.
+*/
+func WithClientIP(r *http.Request, trustedProxies []*net.IPNet) *http.Request {
+
+	peerIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peerIP = r.RemoteAddr
+	}
+
+	ctx := context.WithValue(r.Context(), clientIPKey{}, ClientIP(r, trustedProxies))
+	ctx = context.WithValue(ctx, trustedProxyKey{}, isTrustedProxy(net.ParseIP(peerIP), trustedProxies))
+	return r.WithContext(ctx)
+}
+
+// ClientIPFromContext returns the IP address of the user stored by WithClientIP, or false if it was not stored.
+func ClientIPFromContext(ctx context.Context) (string, bool) {
+
+	ip, ok := ctx.Value(clientIPKey{}).(string)
+	return ip, ok
+}
+
+// FromTrustedProxy returns true if WithClientIP found that the request was received from a trusted proxy.
+func FromTrustedProxy(ctx context.Context) bool {
+
+	trusted, _ := ctx.Value(trustedProxyKey{}).(bool)
+	return trusted
+}
+
+/*
+SetForwardingHeaders appends information about the user to the X-Forwarded-For/Proto/Host, Forwarded (RFC 7239) and Via headers of the request.
+Forwarding headers are kept only if the request was received from a trusted proxy, otherwise values sent by the user are overwritten.
+*/
+func SetForwardingHeaders(r *http.Request, trustedProxies []*net.IPNet) {
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(net.ParseIP(clientIP), trustedProxies) {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+		r.Header.Del("Forwarded")
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+	} else {
+		r.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+
+	// IPv6 addresses must be enclosed in square brackets and quoted.
+	forwardedFor := clientIP
+	if strings.Contains(clientIP, ":") {
+		forwardedFor = strconv.Quote("[" + clientIP + "]")
+	}
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedFor, strconv.Quote(r.Host), proto)
+
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		r.Header.Set("Forwarded", strings.Join(prior, ", ")+", "+forwarded)
+	} else {
+		r.Header.Set("Forwarded", forwarded)
+	}
+
+	r.Header.Add("Via", fmt.Sprintf("%d.%d WebsocketReverseProxy", r.ProtoMajor, r.ProtoMinor))
+}
@@ -0,0 +1,139 @@
+package util
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCopyRequest(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		target       string
+		preserveHost bool
+
+		wantURL  string
+		wantPath string
+		wantHost string
+	}{
+		{
+			name:     "query string is preserved",
+			target:   "http://proxy.example/search?q=a+b&page=2&q=c",
+			wantURL:  "http://10.0.0.1:8080/search?q=a+b&page=2&q=c",
+			wantPath: "/search",
+			wantHost: "10.0.0.1:8080",
+		},
+		{
+			name:     "escaped path is preserved",
+			target:   "http://proxy.example/a%2Fb",
+			wantURL:  "http://10.0.0.1:8080/a%2Fb",
+			wantPath: "/a/b",
+			wantHost: "10.0.0.1:8080",
+		},
+		{
+			name:     "escaped path and query string are preserved",
+			target:   "http://proxy.example/files/a%2Fb%20c?raw=%2F",
+			wantURL:  "http://10.0.0.1:8080/files/a%2Fb%20c?raw=%2F",
+			wantPath: "/files/a/b c",
+			wantHost: "10.0.0.1:8080",
+		},
+		{
+			name:     "empty query",
+			target:   "http://proxy.example/path?",
+			wantURL:  "http://10.0.0.1:8080/path",
+			wantPath: "/path",
+			wantHost: "10.0.0.1:8080",
+		},
+		{
+			name:     "host is rewritten",
+			target:   "http://proxy.example/",
+			wantURL:  "http://10.0.0.1:8080/",
+			wantPath: "/",
+			wantHost: "10.0.0.1:8080",
+		},
+		{
+			name:         "host is passed through",
+			target:       "http://proxy.example/",
+			preserveHost: true,
+			wantURL:      "http://10.0.0.1:8080/",
+			wantPath:     "/",
+			wantHost:     "proxy.example",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest("GET", test.target, nil)
+
+			r2, err := CopyRequest(r, "10.0.0.1:8080", test.preserveHost)
+			if err != nil {
+				t.Fatalf("CopyRequest returned error : %s", err.Error())
+			}
+
+			if got := r2.URL.String(); got != test.wantURL {
+				t.Errorf("URL = %q, want %q", got, test.wantURL)
+			}
+			if r2.URL.Path != test.wantPath {
+				t.Errorf("Path = %q, want %q", r2.URL.Path, test.wantPath)
+			}
+			if r2.URL.RawQuery != r.URL.RawQuery {
+				t.Errorf("RawQuery = %q, want %q", r2.URL.RawQuery, r.URL.RawQuery)
+			}
+			if r2.Host != test.wantHost {
+				t.Errorf("Host = %q, want %q", r2.Host, test.wantHost)
+			}
+			if r2.URL.Host != "10.0.0.1:8080" {
+				t.Errorf("URL.Host = %q, want %q", r2.URL.Host, "10.0.0.1:8080")
+			}
+		})
+	}
+}
+
+func TestWithClientIP(t *testing.T) {
+
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies := []*net.IPNet{trusted}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+
+		wantIP      string
+		wantTrusted bool
+	}{
+		{
+			name:       "user connected directly",
+			remoteAddr: "203.0.113.7:4000",
+			forwarded:  "198.51.100.1",
+			wantIP:     "203.0.113.7",
+		},
+		{
+			name:        "user behind trusted proxies",
+			remoteAddr:  "10.0.0.2:4000",
+			forwarded:   "198.51.100.1, 203.0.113.7, 10.0.0.3",
+			wantIP:      "203.0.113.7",
+			wantTrusted: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest("GET", "http://proxy.example/", nil)
+			r.RemoteAddr = test.remoteAddr
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+
+			r = WithClientIP(r, trustedProxies)
+
+			if ip, _ := ClientIPFromContext(r.Context()); ip != test.wantIP {
+				t.Errorf("client IP = %q, want %q", ip, test.wantIP)
+			}
+			if trusted := FromTrustedProxy(r.Context()); trusted != test.wantTrusted {
+				t.Errorf("FromTrustedProxy = %v, want %v", trusted, test.wantTrusted)
+			}
+		})
+	}
+}
@@ -1,96 +1,529 @@
 package util
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Adarsh-Kmt/WebsocketReverseProxy/metrics"
 	"github.com/gorilla/websocket"
 )
 
-func HandleWebsocketConnClosure(conn *websocket.Conn, message string) error {
+// ping modes of a websocket relay.
+const (
+	// ping and pong frames are forwarded to the other side of the relay.
+	PingRelay = "relay"
+	// ping frames are answered by the proxy, and ping/pong frames are not forwarded.
+	PingAnswer = "answer"
+)
 
-	err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, message))
+const (
+	// maximum time taken to write a control frame.
+	controlWriteTimeout = time.Second
+	// time given to a side of the relay to answer a close frame, before its connection is closed.
+	closeGracePeriod = 5 * time.Second
+	// payload of the ping frames sent by the proxy, pong frames answering them are not forwarded.
+	keepalivePayload = "proxy-keepalive"
+)
 
-	return err
+// RelayConfig contains the configuration of the relay between a user websocket connection and a server websocket connection.
+type RelayConfig struct {
+	PingMode string
+
+	KeepaliveInterval time.Duration // interval at which ping frames are sent to both sides. 0 disables keepalive pings.
+	KeepaliveTimeout  time.Duration // a side is considered dead if no frame is received within KeepaliveInterval + KeepaliveTimeout.
+	IdleTimeout       time.Duration // the session is closed if no message is relayed within IdleTimeout. 0 disables the timeout.
+	MaxLifetime       time.Duration // the session is closed once it has been open for MaxLifetime. 0 disables the limit.
 }
 
-// go routine listens to end server websocket connection, writes to user websocket connection.
-func StartListeningToServer(userWebsocketConn *websocket.Conn, serverWebsocketConn *websocket.Conn, logger *log.Logger) {
+// headers of a websocket handshake that are set by the websocket library, so they are never copied between the user's and server's handshakes.
+var websocketHandshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Accept",
+}
 
-	logger.Println("listening to server for messages.....")
-	for {
+// HandshakeHeaderPolicy decides which headers of the user's websocket handshake request are sent to the server.
+type HandshakeHeaderPolicy struct {
+	All     bool            // if true, every header is sent.
+	Allowed map[string]bool // canonical names of the headers sent, if All is false.
+}
 
-		_, b, err := serverWebsocketConn.ReadMessage()
+// ParseHandshakeHeaderPolicy parses a policy of the form all, or a comma separated list of header names.
+func ParseHandshakeHeaderPolicy(val string) HandshakeHeaderPolicy {
 
-		//log.Printf("load balancer received byte message of length %d from end server.", len(b))
+	if val = strings.TrimSpace(val); val == "" || strings.EqualFold(val, "all") {
+		return HandshakeHeaderPolicy{All: true}
+	}
 
-		if err != nil {
+	policy := HandshakeHeaderPolicy{Allowed: make(map[string]bool)}
+	for _, name := range strings.Split(val, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			policy.Allowed[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return policy
+}
 
-			if closeError, ok := err.(*websocket.CloseError); ok {
-				log.Printf("received conn closure from end server with code: %d message : %s", closeError.Code, closeError.Text)
-				HandleWebsocketConnClosure(userWebsocketConn, "internal server error")
-				break
-			}
-			logger.Fatalf("error while reading message from websocket connection.")
+// Allows returns true if the header is sent to the server.
+func (policy HandshakeHeaderPolicy) Allows(name string) bool {
 
-		}
-		message := string(b)
+	return policy.All || policy.Allowed[http.CanonicalHeaderKey(name)]
+}
+
+/*
+OriginPolicy decides which origins users can open websocket connections from. Requests without an Origin header,
+and requests whose origin has the same host as the request, are always accepted.
+*/
+type OriginPolicy struct {
+	Any     bool            // if true, every origin is accepted.
+	Allowed map[string]bool // lowercase origins accepted, eg: https://app.example.com.
+}
 
-		if message == "" {
-			log.Println("received empty message from end server.")
+// ParseOriginPolicy parses a comma separated list of origins, or * to accept every origin. Returns false if an origin is not of the form scheme://host[:port].
+func ParseOriginPolicy(val string) (OriginPolicy, bool) {
+
+	policy := OriginPolicy{Allowed: make(map[string]bool)}
+
+	for _, origin := range strings.Split(val, ",") {
+		if origin = strings.TrimSpace(origin); origin == "" {
 			continue
-		} else {
-			log.Println(message + " received from the end server.")
 		}
+		if origin == "*" {
+			policy.Any = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return policy, false
+		}
+		policy.Allowed[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+	return policy, true
+}
 
-		err = userWebsocketConn.WriteMessage(websocket.TextMessage, b)
+// Check returns true if the origin of the user's handshake request is accepted. It is used as the CheckOrigin function of websocket upgraders.
+func (policy OriginPolicy) Check(r *http.Request) bool {
 
-		if err != nil {
+	origin := r.Header.Get("Origin")
+	if origin == "" || policy.Any {
+		return true
+	}
 
-			if closeError, ok := err.(*websocket.CloseError); ok {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return policy.Allowed[strings.ToLower(u.Scheme+"://"+u.Host)]
+}
 
-				logger.Printf("received conn closure from user with code: %d message : %s", closeError.Code, closeError.Text)
-				HandleWebsocketConnClosure(serverWebsocketConn, "user closed websocket connection")
-				break
-			}
-			logger.Fatalf("error while writing message to websocket connection.")
+/*
+HandshakeResponseHeaders returns the headers of the server's handshake response that are sent to the user along with the 101 response, eg: Set-Cookie.
+Hop-by-hop headers, and headers set by the websocket upgrader, are not sent. The selected subprotocol is set on the upgrader instead.
+*/
+func HandshakeResponseHeaders(resp *http.Response) http.Header {
+
+	header := resp.Header.Clone()
+
+	RemoveHopByHopHeaders(header)
+	for _, key := range websocketHandshakeHeaders {
+		header.Del(key)
+	}
+	return header
+}
 
+/*
+CopyHandshakeRejection writes the response of a server that rejected the websocket handshake (eg: 401, 403, 404) to the ResponseWriter.
+Headers are filtered as in HandshakeResponseHeaders. Only the first 1024 bytes of the body are kept by the websocket library, so Content-Length is not sent.
+*/
+func CopyHandshakeRejection(w http.ResponseWriter, resp *http.Response) error {
+
+	header := w.Header()
+	for key, values := range HandshakeResponseHeaders(resp) {
+		header[key] = values
+	}
+	header.Del("Content-Length")
+
+	w.WriteHeader(resp.StatusCode)
+
+	_, err := io.Copy(w, resp.Body)
+	return err
+}
+
+/*
+forwardClose sends a close frame with the close code and reason received from the other side of the relay.
+Close codes that cannot be sent in a close frame are replaced, 1005 (no status) is sent as a close frame without a code,
+and 1006 (connection dropped) / 1015 (TLS failure) are sent as 1001 (going away).
+Returns nil if a close frame has already been sent on conn.
+*/
+func forwardClose(conn *websocket.Conn, code int, text string) error {
+
+	var payload []byte
+
+	switch code {
+	case websocket.CloseNoStatusReceived:
+		payload = []byte{}
+	case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		payload = websocket.FormatCloseMessage(websocket.CloseGoingAway, text)
+	default:
+		payload = websocket.FormatCloseMessage(code, text)
+	}
+
+	if err := conn.WriteControl(websocket.CloseMessage, payload, time.Now().Add(controlWriteTimeout)); err != nil && err != websocket.ErrCloseSent {
+		return err
+	}
+	return nil
+}
+
+// returns a control frame handler that writes the payload of the frame to conn, as a control frame of messageType.
+func forwardControl(conn *websocket.Conn, messageType int) func(string) error {
+
+	return func(payload string) error {
+
+		err := conn.WriteControl(messageType, []byte(payload), time.Now().Add(controlWriteTimeout))
+
+		// the other side is closing, its close frame is forwarded by the relay.
+		if err == websocket.ErrCloseSent {
+			return nil
 		}
+		return err
+	}
+}
+
+// relayDirection describes one of the two directions in which a relay session forwards frames.
+type relayDirection struct {
+	src, dst         *websocket.Conn
+	srcName, dstName string
+
+	srcFailedCode int // close code sent to dst when the src connection fails.
+	dstFailedCode int // close code sent to src when the dst connection fails.
+}
 
+/*
+RelaySession relays frames between a user websocket connection and a server websocket connection, using one go routine for each direction.
+Close frames are forwarded to the other side, which answers them, and the session ends once both sides have closed.
+If either connection fails, only this session is torn down: the other side is sent a close frame
+(1011 to the user if the server failed, 1001 to the server if the user failed) and both connections are closed,
+so that both go routines exit.
+If keepalive is enabled, a side that does not answer pings is treated as a failed connection.
+*/
+type RelaySession struct {
+	UserConn   *websocket.Conn
+	ServerConn *websocket.Conn
+
+	config RelayConfig
+	logger *log.Logger
+
+	reason       string    // reason the session ended, eg: "user closed connection with code 1000".
+	closing      bool      // true once a close frame has been sent, read deadlines are no longer extended.
+	lastActivity time.Time // time at which the last message was relayed.
+	mutex        *sync.Mutex
+
+	teardownOnce *sync.Once
+	done         chan struct{} // closed once both go routines have exited and both connections are closed.
+}
+
+func InitializeRelaySession(userConn *websocket.Conn, serverConn *websocket.Conn, cfg RelayConfig, logger *log.Logger) *RelaySession {
+
+	return &RelaySession{
+		UserConn:     userConn,
+		ServerConn:   serverConn,
+		config:       cfg,
+		logger:       logger,
+		lastActivity: time.Now(),
+		mutex:        &sync.Mutex{},
+		teardownOnce: &sync.Once{},
+		done:         make(chan struct{}),
 	}
 }
 
-// go routine listens to user websocket connection, writes to end server websocket connection.
-func StartListeningToUser(userWebsocketConn *websocket.Conn, serverWebsocketConn *websocket.Conn, logger *log.Logger) {
+/*
+Start sets the control frame handlers of both connections, and starts relaying frames.
+Close frames are not answered by the proxy, they are returned by ReadMessage and forwarded to the other side, which answers them.
+Ping/pong frames are forwarded to the other side in relay mode, and pings are answered by the proxy in answer mode.
+Pongs answering the keepalive pings of the proxy are never forwarded.
+*/
+func (rs *RelaySession) Start() {
+
+	ignoreClose := func(code int, text string) error { return nil }
+
+	for _, conns := range [][2]*websocket.Conn{{rs.UserConn, rs.ServerConn}, {rs.ServerConn, rs.UserConn}} {
+
+		conn, other := conns[0], conns[1]
+		conn.SetCloseHandler(ignoreClose)
+
+		// every frame received shows that the side is alive, so the read deadline is extended.
+		conn.SetPingHandler(func(payload string) error {
+			rs.extendReadDeadline(conn)
+			if rs.config.PingMode == PingRelay {
+				return forwardControl(other, websocket.PingMessage)(payload)
+			}
+			return forwardControl(conn, websocket.PongMessage)(payload)
+		})
+		conn.SetPongHandler(func(payload string) error {
+			rs.extendReadDeadline(conn)
+			if rs.config.PingMode == PingRelay && payload != keepalivePayload {
+				return forwardControl(other, websocket.PongMessage)(payload)
+			}
+			return nil
+		})
+		rs.extendReadDeadline(conn)
+	}
+
+	relayWaitGroup := &sync.WaitGroup{}
+	relayWaitGroup.Add(2)
+
+	go func() {
+		defer relayWaitGroup.Done()
+		rs.logger.Println("listening to server for messages.....")
+		rs.relay(relayDirection{src: rs.ServerConn, dst: rs.UserConn, srcName: "server", dstName: "user", srcFailedCode: websocket.CloseInternalServerErr, dstFailedCode: websocket.CloseGoingAway})
+	}()
+	go func() {
+		defer relayWaitGroup.Done()
+		rs.logger.Println("listening to user for messages.....")
+		rs.relay(relayDirection{src: rs.UserConn, dst: rs.ServerConn, srcName: "user", dstName: "server", srcFailedCode: websocket.CloseGoingAway, dstFailedCode: websocket.CloseInternalServerErr})
+	}()
+
+	// connections are closed once both go routines stop relaying messages.
+	go func() {
+		relayWaitGroup.Wait()
+		rs.UserConn.Close()
+		rs.ServerConn.Close()
+		rs.logger.Printf("websocket relay ended : %s", rs.Reason())
+		close(rs.done)
+	}()
+
+	go rs.monitor()
+}
+
+/*
+monitor sends keepalive pings to both sides, and closes the session when the idle timeout or maximum lifetime is exceeded.
+It returns once the session has ended.
+*/
+func (rs *RelaySession) monitor() {
+
+	// nil channels are never ready, so disabled timers are never selected.
+	var keepalive, idle, lifetime <-chan time.Time
+
+	if rs.config.KeepaliveInterval > 0 {
+		ticker := time.NewTicker(rs.config.KeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	var idleTimer *time.Timer
+	if rs.config.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(rs.config.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	if rs.config.MaxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(rs.config.MaxLifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
 
-	logger.Println("listening to user for messages.....")
 	for {
+		select {
 
-		_, b, err := userWebsocketConn.ReadMessage()
+		case <-rs.done:
+			return
 
-		if err != nil {
+		case <-keepalive:
+			for _, conn := range []*websocket.Conn{rs.UserConn, rs.ServerConn} {
+				// a side that cannot be written to also stops answering pings, and fails once its read deadline is exceeded.
+				if err := conn.WriteControl(websocket.PingMessage, []byte(keepalivePayload), time.Now().Add(controlWriteTimeout)); err != nil && err != websocket.ErrCloseSent {
+					rs.logger.Printf("error while sending keepalive ping : %s", err.Error())
+				}
+			}
 
-			if closeError, ok := err.(*websocket.CloseError); ok {
+		case <-idle:
+			rs.mutex.Lock()
+			idleFor := time.Since(rs.lastActivity)
+			rs.mutex.Unlock()
 
-				logger.Printf("received conn closure from user with code: %d message : %s", closeError.Code, closeError.Text)
-				HandleWebsocketConnClosure(serverWebsocketConn, "user closed websocket connection")
-				break
+			if idleFor < rs.config.IdleTimeout {
+				idleTimer.Reset(rs.config.IdleTimeout - idleFor)
+				continue
 			}
-			logger.Fatalf("error while reading message from websocket connection : %s", err.Error())
+			rs.Close(websocket.CloseGoingAway, "idle timeout", "idle_timeout")
+
+		case <-lifetime:
+			rs.Close(websocket.CloseGoingAway, "maximum connection lifetime exceeded", "max_lifetime")
+		}
+	}
+}
 
+/*
+Close ends the session on behalf of the proxy. Both sides are sent a close frame with code and text,
+and have closeGracePeriod to answer it before their connections are closed. label is used to count sessions by reason.
+Does nothing if the session is already closing.
+*/
+func (rs *RelaySession) Close(code int, text string, label string) {
+
+	// closing is checked and set together, so that concurrent calls send close frames only once.
+	rs.mutex.Lock()
+	if rs.closing {
+		rs.mutex.Unlock()
+		return
+	}
+	rs.closing = true
+	rs.mutex.Unlock()
+
+	rs.recordReason(label, fmt.Sprintf("proxy closed connection with code %d : %s", code, text))
+	rs.logger.Printf("closing websocket relay with code %d : %s", code, text)
+
+	for _, conn := range []*websocket.Conn{rs.UserConn, rs.ServerConn} {
+		if err := forwardClose(conn, code, text); err != nil {
+			rs.logger.Printf("error while sending close frame : %s", err.Error())
 		}
-		err = serverWebsocketConn.WriteMessage(websocket.BinaryMessage, b)
+	}
+	rs.awaitCloseReply(rs.UserConn, rs.ServerConn)
+}
+
+// Terminate closes both connections immediately, without waiting for close frames sent to them to be answered.
+func (rs *RelaySession) Terminate() {
+
+	rs.UserConn.Close()
+	rs.ServerConn.Close()
+}
+
+// extends the read deadline of conn while keepalive is enabled, unless the session is closing.
+func (rs *RelaySession) extendReadDeadline(conn *websocket.Conn) {
+
+	if rs.config.KeepaliveInterval == 0 {
+		return
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if !rs.closing {
+		conn.SetReadDeadline(time.Now().Add(rs.config.KeepaliveInterval + rs.config.KeepaliveTimeout))
+	}
+}
+
+// marks the session as closing, conns are closed by their read deadline if they do not answer the close frame sent to them within closeGracePeriod.
+func (rs *RelaySession) awaitCloseReply(conns ...*websocket.Conn) {
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	rs.closing = true
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(closeGracePeriod))
+	}
+}
+
+// Done returns a channel that is closed once the session has ended, and both connections are closed.
+func (rs *RelaySession) Done() <-chan struct{} {
+
+	return rs.done
+}
+
+// Reason returns the reason the session ended, or an empty string if it has not ended yet.
+func (rs *RelaySession) Reason() string {
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.reason
+}
+
+// records the reason the session ended, only the first reason is kept. label is used to count sessions by reason.
+func (rs *RelaySession) recordReason(label string, reason string) {
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if rs.reason == "" {
+		rs.reason = reason
+		metrics.AddCounter("proxy_websocket_sessions_closed_total", "number of websocket relay sessions that ended, by reason.", metrics.Labels{"reason": label}, 1)
+	}
+}
+
+/*
+teardown ends the session after the failedName side of the relay failed. peer (the other side) is sent a close frame with code,
+and both connections are closed immediately, which causes both go routines to exit.
+*/
+func (rs *RelaySession) teardown(peer *websocket.Conn, code int, failedName string, reason string) {
+
+	rs.teardownOnce.Do(func() {
+		rs.recordReason(failedName+"_error", reason)
+		rs.logger.Printf("tearing down websocket relay : %s", reason)
+
+		// reason is not sent, as the payload of a close frame is limited to 125 bytes.
+		if err := forwardClose(peer, code, failedName+" connection lost"); err != nil {
+			rs.logger.Printf("error while sending close frame : %s", err.Error())
+		}
+		rs.UserConn.Close()
+		rs.ServerConn.Close()
+	})
+}
+
+/*
+relay reads messages from dir.src and writes them to dir.dst with the same message type, until dir.src sends a close frame or fails.
+The close code and reason are forwarded to dir.dst, which has closeGracePeriod to answer the close frame.
+*/
+func (rs *RelaySession) relay(dir relayDirection) {
+
+	for {
+
+		messageType, b, err := dir.src.ReadMessage()
 
 		if err != nil {
 
-			if closeError, ok := err.(*websocket.CloseError); ok {
+			if closeError, ok := err.(*websocket.CloseError); ok && closeError.Code != websocket.CloseAbnormalClosure {
+				rs.logger.Printf("received conn closure from %s with code: %d message : %s", dir.srcName, closeError.Code, closeError.Text)
+				rs.recordReason(dir.srcName+"_closed", fmt.Sprintf("%s closed connection with code %d", dir.srcName, closeError.Code))
+
+				if err := forwardClose(dir.dst, closeError.Code, closeError.Text); err != nil {
+					rs.teardown(dir.src, dir.dstFailedCode, dir.dstName, fmt.Sprintf("error while forwarding conn closure to %s : %s", dir.dstName, err.Error()))
+					return
+				}
+				// dst should answer the close frame, or its connection is closed.
+				rs.awaitCloseReply(dir.dst)
+				return
+			}
 
-				logger.Printf("received conn closure from server with code: %d message : %s", closeError.Code, closeError.Text)
-				HandleWebsocketConnClosure(userWebsocketConn, "user closed websocket connection")
-				break
+			// src did not answer keepalive pings, or a close frame sent to it.
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				rs.recordReason(dir.srcName+"_timeout", fmt.Sprintf("no frames received from %s before the read deadline", dir.srcName))
+				if err := forwardClose(dir.src, websocket.CloseGoingAway, "keepalive timeout"); err != nil {
+					rs.logger.Printf("error while sending close frame : %s", err.Error())
+				}
 			}
-			logger.Fatalf("error while writing message to websocket connection : %s", err.Error())
 
+			rs.teardown(dir.dst, dir.srcFailedCode, dir.srcName, fmt.Sprintf("error while reading message from %s : %s", dir.srcName, err.Error()))
+			return
 		}
 
+		rs.mutex.Lock()
+		rs.lastActivity = time.Now()
+		rs.mutex.Unlock()
+		rs.extendReadDeadline(dir.src)
+
+		if err := dir.dst.WriteMessage(messageType, b); err != nil {
+
+			// a close frame was sent to dst, messages received until src answers the close frame are dropped.
+			if err == websocket.ErrCloseSent {
+				continue
+			}
+			rs.teardown(dir.src, dir.dstFailedCode, dir.dstName, fmt.Sprintf("error while writing message to %s : %s", dir.dstName, err.Error()))
+			return
+		}
 	}
 }
@@ -0,0 +1,170 @@
+package util
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// relayTestSession is a user connected to a server through a relay session.
+type relayTestSession struct {
+	userConn   *websocket.Conn
+	serverConn *websocket.Conn
+	session    *RelaySession
+}
+
+// startRelayTestSession starts an upstream server and a proxy relaying to it, and connects a user to the proxy.
+func startRelayTestSession(t *testing.T) relayTestSession {
+
+	upgrader := websocket.Upgrader{}
+	serverConns := make(chan *websocket.Conn, 1)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upstream upgrade failed : %s", err.Error())
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(upstream.Close)
+
+	sessions := make(chan *RelaySession, 1)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(upstream.URL, "http"), nil)
+		if err != nil {
+			t.Errorf("dial to upstream failed : %s", err.Error())
+			return
+		}
+		userConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("proxy upgrade failed : %s", err.Error())
+			serverConn.Close()
+			return
+		}
+		session := InitializeRelaySession(userConn, serverConn, RelayConfig{PingMode: PingRelay}, log.New(io.Discard, "", 0))
+		session.Start()
+		sessions <- session
+	}))
+	t.Cleanup(proxy.Close)
+
+	userConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial to proxy failed : %s", err.Error())
+	}
+	t.Cleanup(func() { userConn.Close() })
+
+	rts := relayTestSession{userConn: userConn}
+
+	select {
+	case rts.serverConn = <-serverConns:
+		t.Cleanup(func() { rts.serverConn.Close() })
+	case <-time.After(time.Second):
+		t.Fatal("server connection was not established")
+	}
+	select {
+	case rts.session = <-sessions:
+	case <-time.After(time.Second):
+		t.Fatal("relay session was not started")
+	}
+	return rts
+}
+
+// expectClose reads from conn until it receives a close frame, and checks its close code.
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		closeError, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatalf("read returned %v, want close frame with code %d", err, code)
+		}
+		if closeError.Code != code {
+			t.Fatalf("close code = %d, want %d", closeError.Code, code)
+		}
+		return
+	}
+}
+
+func expectDone(t *testing.T, session *RelaySession) {
+
+	select {
+	case <-session.Done():
+	case <-time.After(time.Second):
+		t.Fatal("relay session did not end")
+	}
+}
+
+func TestRelaySessionUserConnectionLost(t *testing.T) {
+
+	rts := startRelayTestSession(t)
+
+	// the user's connection is dropped without a close frame.
+	rts.userConn.UnderlyingConn().Close()
+
+	expectClose(t, rts.serverConn, websocket.CloseGoingAway)
+	expectDone(t, rts.session)
+}
+
+func TestRelaySessionServerConnectionLost(t *testing.T) {
+
+	rts := startRelayTestSession(t)
+
+	// the server's connection is dropped without a close frame.
+	rts.serverConn.UnderlyingConn().Close()
+
+	expectClose(t, rts.userConn, websocket.CloseInternalServerErr)
+	expectDone(t, rts.session)
+}
+
+func TestOriginPolicyCheck(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		allowed string
+		origin  string
+		want    bool
+	}{
+		{name: "no origin header", origin: "", want: true},
+		{name: "same origin", origin: "https://proxy.example", want: true},
+		{name: "cross origin rejected by default", origin: "https://evil.example", want: false},
+		{name: "listed origin", allowed: "https://app.example, https://admin.example", origin: "https://APP.example", want: true},
+		{name: "origin with different scheme", allowed: "https://app.example", origin: "http://app.example", want: false},
+		{name: "every origin", allowed: "*", origin: "https://evil.example", want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			policy, ok := ParseOriginPolicy(test.allowed)
+			if !ok {
+				t.Fatalf("ParseOriginPolicy(%q) failed", test.allowed)
+			}
+
+			r := httptest.NewRequest("GET", "http://proxy.example/", nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+
+			if got := policy.Check(r); got != test.want {
+				t.Errorf("Check = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, ok := ParseOriginPolicy("app.example"); ok {
+		t.Error("ParseOriginPolicy accepted an origin without a scheme")
+	}
+}